@@ -0,0 +1,395 @@
+// Command ghttpload downloads URLs or the entries of a JSONL manifest
+// with the resume and retry behavior of the ghttpload library.
+//
+// Usage:
+//
+//	ghttpload [flags] url...
+//	ghttpload [flags] -i manifest.jsonl
+//	ghttpload [flags] -metalink file.meta4
+//
+// A single download shows a progress bar, several urls or files run at once
+// like the entries of a manifest, limited by -j and -per-host.
+//
+// Exit codes: 0 when every download completed, 1 when a download failed,
+// 2 on usage or manifest errors.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/supeanut/ghttpload/httplib"
+	"github.com/supeanut/ghttpload/manager"
+	"github.com/supeanut/ghttpload/porter"
+)
+
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+// headerFlag collects repeated -H "Key: Value" flags
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	var s []string
+	for k, v := range h {
+		s = append(s, k+": "+v)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("header %q is not \"Key: Value\"", value)
+	}
+	h[strings.TrimSpace(value[:i])] = strings.TrimSpace(value[i+1:])
+	return nil
+}
+
+// listFlag collects repeated string flags
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type options struct {
+	manifest       string
+	metalink       string
+	locations      string
+	results        string
+	path           string
+	filename       string
+	retries        int
+	connections    int
+	concurrency    int
+	perHost        int
+	headers        headerFlag
+	mirrors        listFlag
+	resolution     string
+	maxBandwidth   int64
+	videoCodecs    string
+	audioCodecs    string
+	connectTimeout time.Duration
+	timeout        time.Duration
+	minSpeed       int64
+	minSpeedWindow time.Duration
+	sync           bool
+	quiet          bool
+	json           bool
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	opts := options{headers: headerFlag{}}
+	fs := flag.NewFlagSet("ghttpload", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: ghttpload [flags] url...")
+		fmt.Fprintln(stderr, "       ghttpload [flags] -i manifest.jsonl")
+		fmt.Fprintln(stderr, "       ghttpload [flags] -metalink file.meta4")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.manifest, "i", "", "read download jobs from a JSONL `manifest`, - for stdin")
+	fs.StringVar(&opts.metalink, "metalink", "", "download the files of a Metalink `file`, - for stdin")
+	fs.StringVar(&opts.locations, "location", "", "prefer Metalink mirrors in these comma separated `countries`, like de,fr")
+	fs.StringVar(&opts.results, "results", "", "write JSONL results of the manifest to `file`")
+	fs.StringVar(&opts.path, "d", "", "`directory` to save downloads in")
+	fs.StringVar(&opts.filename, "o", "", "`filename` of the download, only with a single url, - writes to stdout")
+	fs.IntVar(&opts.retries, "r", 3, "`retries` of each download, -1 retries forever")
+	fs.IntVar(&opts.connections, "c", 1, "parallel `connections` per download")
+	fs.IntVar(&opts.concurrency, "j", 4, "downloads running at once")
+	fs.IntVar(&opts.perHost, "per-host", 2, "downloads running at once against one host, 0 means no limit")
+	fs.Var(&opts.mirrors, "m", "add a `mirror` of the url, may be repeated, only with a single url")
+	fs.StringVar(&opts.resolution, "resolution", "", "pick the HLS variant of this `resolution`, like 1280x720")
+	fs.Int64Var(&opts.maxBandwidth, "max-bandwidth", 0, "pick the best HLS variant or DASH video within these `bits` per second")
+	fs.StringVar(&opts.videoCodecs, "video-codecs", "", "pick a DASH video representation of these `codecs`, like avc1")
+	fs.StringVar(&opts.audioCodecs, "audio-codecs", "", "pick a DASH audio representation of these `codecs`, like mp4a")
+	fs.Var(opts.headers, "H", "add a request `header` \"Key: Value\", may be repeated")
+	fs.DurationVar(&opts.connectTimeout, "connect-timeout", 60*time.Second, "connect `timeout`")
+	fs.DurationVar(&opts.timeout, "timeout", 60*time.Second, "`timeout` of a read or write which receives or sends nothing")
+	fs.Int64Var(&opts.minSpeed, "min-speed", 0, "reconnect when a download stays below these `bytes` per second, 0 means no minimum")
+	fs.DurationVar(&opts.minSpeedWindow, "min-speed-window", porter.DefaultMinSpeedWindow, "`time` a download may stay below -min-speed")
+	fs.BoolVar(&opts.sync, "sync", false, "download files again only when the server reports a change since the last sync")
+	fs.BoolVar(&opts.quiet, "quiet", false, "print nothing but errors")
+	fs.BoolVar(&opts.json, "json", false, "print one JSON result per download")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	urls := fs.Args()
+	switch {
+	case opts.manifest == "" && opts.metalink == "" && len(urls) == 0:
+		fs.Usage()
+		return exitUsage
+	case opts.manifest != "" && len(urls) > 0:
+		fmt.Fprintln(stderr, "ghttpload: -i can't be used together with urls")
+		return exitUsage
+	case opts.metalink != "" && (len(urls) > 0 || opts.manifest != ""):
+		fmt.Fprintln(stderr, "ghttpload: -metalink can't be used together with urls or -i")
+		return exitUsage
+	case opts.filename != "" && len(urls) > 1:
+		fmt.Fprintln(stderr, "ghttpload: -o can only be used with a single url")
+		return exitUsage
+	case opts.filename == "-" && opts.json:
+		fmt.Fprintln(stderr, "ghttpload: -json can't be used when writing to stdout")
+		return exitUsage
+	case opts.filename == "-" && opts.sync:
+		fmt.Fprintln(stderr, "ghttpload: -sync can't be used when writing to stdout")
+		return exitUsage
+	case len(opts.mirrors) > 0 && len(urls) != 1:
+		fmt.Fprintln(stderr, "ghttpload: -m can only be used with a single url")
+		return exitUsage
+	}
+
+	setting := httplib.GetDefaultSetting()
+	setting.ConnectTimeout = opts.connectTimeout
+	setting.ReadWriteTimeout = opts.timeout
+	httplib.SetDefaultSetting(setting)
+
+	if opts.manifest != "" {
+		return runManifest(opts, stdout, stderr)
+	}
+	if opts.metalink != "" {
+		return runMetalink(opts, stdout, stderr)
+	}
+	return runURLs(opts, urls, stdout, stderr)
+}
+
+// jobOptions are the flags every download is configured with
+func jobOptions(opts options) []manager.Option {
+	options := []manager.Option{
+		manager.Retries(opts.retries),
+		manager.Connections(opts.connections),
+		manager.Variant(opts.resolution, opts.maxBandwidth),
+		manager.Video(opts.videoCodecs, opts.maxBandwidth),
+		manager.Audio(opts.audioCodecs, 0),
+		manager.MinSpeed(opts.minSpeed, opts.minSpeedWindow),
+	}
+	if opts.sync {
+		options = append(options, manager.Sync())
+	}
+	for k, v := range opts.headers {
+		options = append(options, manager.Header(k, v))
+	}
+	return options
+}
+
+func runManifest(opts options, stdout, stderr io.Writer) int {
+	in := os.Stdin
+	if opts.manifest != "-" {
+		f, err := os.Open(opts.manifest)
+		if err != nil {
+			fmt.Fprintln(stderr, "ghttpload:", err)
+			return exitUsage
+		}
+		defer f.Close()
+		in = f
+	}
+	var out io.Writer = nopWriter{}
+	if opts.results != "" {
+		f, err := os.Create(opts.results)
+		if err != nil {
+			fmt.Fprintln(stderr, "ghttpload:", err)
+			return exitUsage
+		}
+		defer f.Close()
+		out = f
+	}
+
+	results, err := newManager(opts).RunManifest(in, out)
+	if _, ok := err.(manager.ManifestErrors); ok {
+		fmt.Fprintln(stderr, "ghttpload: invalid manifest:")
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "ghttpload:", err)
+		return exitFailed
+	}
+	return reportAll(opts, results, stdout, stderr)
+}
+
+func runMetalink(opts options, stdout, stderr io.Writer) int {
+	files, err := porter.ParseMetalinkFile(opts.metalink)
+	if err != nil {
+		fmt.Fprintln(stderr, "ghttpload: invalid metalink:", err)
+		return exitUsage
+	}
+	if opts.filename != "" && len(files) > 1 {
+		fmt.Fprintln(stderr, "ghttpload: -o can only be used with a single file")
+		return exitUsage
+	}
+	var locations []string
+	if opts.locations != "" {
+		locations = strings.Split(opts.locations, ",")
+	}
+	if len(files) == 1 {
+		p := newPorter(opts, files[0].URLs[0].Url)
+		p.SetMetalink(files[0], locations...)
+		return runPorter(opts, p, stdout, stderr)
+	}
+	jobs := make([]manager.Job, len(files))
+	for i, f := range files {
+		jobs[i] = manager.Job{Url: f.URLs[0].Url, Options: []manager.Option{manager.Metalink(f, locations...)}}
+	}
+	return runJobs(opts, jobs, stdout, stderr)
+}
+
+func runURLs(opts options, urls []string, stdout, stderr io.Writer) int {
+	if len(urls) == 1 {
+		return runPorter(opts, newPorter(opts, urls[0]), stdout, stderr)
+	}
+	jobs := make([]manager.Job, len(urls))
+	for i, u := range urls {
+		jobs[i] = manager.Job{Url: u}
+	}
+	return runJobs(opts, jobs, stdout, stderr)
+}
+
+// runPorter downloads a single file in the foreground
+func runPorter(opts options, p *porter.Porter, stdout, stderr io.Writer) int {
+	r := download(opts, p, stdout, stderr)
+	r.Line = 1
+	if opts.filename == "-" {
+		// stdout carries the download itself
+		stdout = stderr
+	}
+	return reportAll(opts, []manager.Result{r}, stdout, stderr)
+}
+
+// runJobs downloads several files at once through a manager, limited by -j and -per-host
+func runJobs(opts options, jobs []manager.Job, stdout, stderr io.Writer) int {
+	results, err := newManager(opts).RunJobs(jobs, nopWriter{})
+	if err != nil {
+		fmt.Fprintln(stderr, "ghttpload:", err)
+		return exitFailed
+	}
+	return reportAll(opts, results, stdout, stderr)
+}
+
+// newManager returns a manager limited and configured by the flags
+func newManager(opts options) *manager.Manager {
+	m := manager.NewManager(opts.concurrency, opts.perHost)
+	m.Path = opts.path
+	m.Options = jobOptions(opts)
+	return m
+}
+
+// reportAll prints every result and returns the exit code
+func reportAll(opts options, results []manager.Result, stdout, stderr io.Writer) int {
+	code := exitOK
+	for _, r := range results {
+		if r.Status != manager.StatusCompleted.String() {
+			code = exitFailed
+		}
+		report(opts, r, stdout, stderr)
+	}
+	return code
+}
+
+// newPorter configures a porter for rawurl with the flags
+func newPorter(opts options, rawurl string) *porter.Porter {
+	p := porter.NewPorter()
+	p.SetUrl(rawurl)
+	p.SetPath(opts.path)
+	if opts.filename != "-" {
+		p.SetFilename(opts.filename)
+	}
+	p.SetRetries(opts.retries)
+	p.SetConnections(opts.connections)
+	p.SetVariant(opts.resolution, opts.maxBandwidth)
+	p.SetVideo(opts.videoCodecs, opts.maxBandwidth)
+	p.SetAudio(opts.audioCodecs, 0)
+	p.SetMinSpeed(opts.minSpeed, opts.minSpeedWindow)
+	p.SetSync(opts.sync)
+	for k, v := range opts.headers {
+		p.SetHeader(k, v)
+	}
+	for _, mirror := range opts.mirrors {
+		p.AddMirror(mirror)
+	}
+	return p
+}
+
+// download fetches one porter in the foreground, showing a progress bar unless asked not to.
+// With -o - it is written to stdout and the bar to stderr. Line of the result is left to the caller
+func download(opts options, p *porter.Porter, stdout, stderr io.Writer) manager.Result {
+	start := time.Now()
+	switch {
+	case opts.quiet || opts.json:
+		p.SetProgress(porter.NopReporter{})
+	case opts.filename == "-":
+		bar := porter.NewBarReporter()
+		bar.Bar.Output = stderr
+		p.SetProgress(bar)
+	}
+	result := manager.Result{Url: p.Stream.URL.Url, Status: manager.StatusCompleted.String()}
+	err := p.Extract()
+	switch {
+	case err == nil && opts.filename == "-":
+		err = p.DownloadTo(context.Background(), stdout)
+		result.Bytes, result.Path = p.Stream.Size, "-"
+	case err == nil:
+		err = p.Download()
+		result.Bytes, _ = p.GetFileSize()
+		if err == nil {
+			result.Path, err = p.OutputPath()
+		}
+	}
+	result.Duration = time.Since(start).Seconds()
+	if stats := p.MirrorStats(); len(stats) > 1 {
+		result.Mirrors = manager.MirrorBytes(stats)
+	}
+	result.Splits = p.SegmentStats().Splits
+	result.Unchanged = p.Stream.Unchanged
+	if err != nil {
+		result.Status = manager.StatusFailed.String()
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// report prints the result of one download according to the output flags
+func report(opts options, r manager.Result, stdout, stderr io.Writer) {
+	switch {
+	case opts.json:
+		json.NewEncoder(stdout).Encode(r)
+	case r.Error != "":
+		fmt.Fprintf(stderr, "ghttpload: %s: %s\n", r.Url, r.Error)
+	case !opts.quiet && r.Unchanged:
+		fmt.Fprintf(stdout, "%s -> %s (unchanged)\n", r.Url, r.Path)
+	case !opts.quiet:
+		fmt.Fprintf(stdout, "%s -> %s (%d bytes in %.1fs)\n", r.Url, r.Path, r.Bytes, r.Duration)
+		if r.Splits > 0 {
+			fmt.Fprintf(stdout, "  %d ranges split for idle connections\n", r.Splits)
+		}
+		for u, n := range r.Mirrors {
+			fmt.Fprintf(stdout, "  %d bytes from %s\n", n, u)
+		}
+	}
+}
+
+// nopWriter discards the manifest results when no -results file is given
+type nopWriter struct{}
+
+func (nopWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
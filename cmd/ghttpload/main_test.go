@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/supeanut/ghttpload/manager"
+)
+
+func testServer(content []byte, running, maxRunning *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			n := atomic.AddInt32(running, 1)
+			defer atomic.AddInt32(running, -1)
+			for {
+				max := atomic.LoadInt32(maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "file", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+}
+
+func TestRun(t *testing.T) {
+	content := bytes.Repeat([]byte("ghttpload"), 1024)
+	var running, maxRunning int32
+	ts := testServer(content, &running, &maxRunning)
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "ghttpload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		args []string
+		code int
+	}{
+		{nil, exitUsage},
+		{[]string{"-i", "jobs.jsonl", ts.URL + "/a"}, exitUsage},
+		{[]string{"-o", "a", ts.URL + "/a", ts.URL + "/b"}, exitUsage},
+		{[]string{"-json", "-o", "-", ts.URL + "/a"}, exitUsage},
+		{[]string{"-unknown"}, exitUsage},
+		{[]string{"-quiet", "-d", dir, "-o", "a", ts.URL + "/a"}, exitOK},
+		{[]string{"-quiet", "-r", "0", "-d", dir, ts.URL + "/missing"}, exitFailed},
+	} {
+		var stdout, stderr bytes.Buffer
+		if code := run(c.args, &stdout, &stderr); code != c.code {
+			t.Fatalf("%q: exit code %d, want %d: %s", c.args, code, c.code, stderr.String())
+		}
+		if strings.Contains(strings.Join(c.args, " "), "-quiet") && stdout.Len() != 0 {
+			t.Fatalf("%q: printed %q", c.args, stdout.String())
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "a")); err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+}
+
+func TestRunJSON(t *testing.T) {
+	content := bytes.Repeat([]byte("ghttpload"), 1024)
+	var running, maxRunning int32
+	ts := testServer(content, &running, &maxRunning)
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "ghttpload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"-json", "-r", "0", "-j", "2", "-per-host", "2", "-d", dir,
+		ts.URL + "/one", ts.URL + "/two", ts.URL + "/missing"}
+	if code := run(args, &stdout, &stderr); code != exitFailed {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	dec := json.NewDecoder(&stdout)
+	for i, want := range []string{"completed", "completed", "failed"} {
+		var r manager.Result
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Line != i+1 || r.Status != want || want == "completed" && r.Bytes != int64(len(content)) {
+			t.Fatalf("result %d: %+v", i, r)
+		}
+	}
+	if atomic.LoadInt32(&maxRunning) != 2 {
+		t.Fatalf("%d downloads ran at once, want 2", maxRunning)
+	}
+}
+
+func TestRunStdout(t *testing.T) {
+	content := bytes.Repeat([]byte("ghttpload"), 1024)
+	var running, maxRunning int32
+	ts := testServer(content, &running, &maxRunning)
+	defer ts.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-quiet", "-o", "-", ts.URL + "/a"}, &stdout, &stderr); code != exitOK {
+		t.Fatalf("exit code %d: %s", code, stderr.String())
+	}
+	if !bytes.Equal(stdout.Bytes(), content) || stderr.Len() != 0 {
+		t.Fatalf("got %d bytes on stdout and %q on stderr", stdout.Len(), stderr.String())
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"github.com/supeanut/ghttpload"
 	"fmt"
-	"time"
 )
 
 func main() {
@@ -14,16 +13,14 @@ func main() {
 	porter.SetFilename("abc")
 	porter.Extract()
 	fmt.Println(porter.Stream.URL.Size)
+	reporter := ghttpload.NewChanReporter(16)
+	porter.SetProgress(reporter)
 	go func() {
-		for {
-			s, err := porter.GetFileSize()
+		for e := range reporter.C {
 			fmt.Println("=========================")
-			fmt.Printf("size:%d,err:%v\n",s,err)
+			fmt.Printf("size:%d/%d,state:%s,err:%v\n",e.Current,e.Total,porter.State(),e.Err)
 			fmt.Println("=========================")
-			time.Sleep(2 * time.Second)
 		}
-
-
 	}()
 	porter.Download()
 }
@@ -1,6 +1,11 @@
 package ghttpload
 
-import "github.com/supeanut/ghttpload/porter"
+import (
+	"github.com/supeanut/ghttpload/porter"
+	"github.com/supeanut/ghttpload/manager"
+	"github.com/supeanut/ghttpload/httplib"
+	"io"
+)
 
 /*
 	Package ghttpload is used as downloader
@@ -15,6 +20,44 @@ func NewPorter() *porter.Porter {
 	return porter.NewPorter()
 }
 
+// NewManager returns a download manager running at most concurrency jobs,
+// and at most perHost jobs against one host
+func NewManager(concurrency, perHost int) *manager.Manager {
+	return manager.NewManager(concurrency, perHost)
+}
+
+// NewChanReporter returns a progress reporter sending events on a channel
+func NewChanReporter(size int) *porter.ChanReporter {
+	return porter.NewChanReporter(size)
+}
+
+// LoadManifest parses a JSONL manifest into download jobs,
+// invalid lines are reported with their line numbers
+func LoadManifest(r io.Reader) ([]manager.Job, error) {
+	return manager.LoadManifest(r)
+}
+
+// RunManifest downloads every entry of the manifest read from r
+// and writes a JSONL result line for each entry to w
+func RunManifest(r io.Reader, w io.Writer, concurrency, perHost int) ([]manager.Result, error) {
+	return manager.NewManager(concurrency, perHost).RunManifest(r, w)
+}
+
+// set porter progress reporter
+func SetProgress(reporter porter.ProgressReporter) {
+	defaultPorter.SetProgress(reporter)
+}
+
+// set porter rate limit in bytes per second
+func SetRateLimit(bytesPerSec int64) {
+	defaultPorter.SetRateLimit(bytesPerSec)
+}
+
+// set the rate limit shared by all porters in bytes per second
+func SetGlobalRateLimit(bytesPerSec int64) {
+	porter.SetGlobalRateLimit(bytesPerSec)
+}
+
 // set porter path
 func SetPath(path string) {
 	defaultPorter.SetPath(path)
@@ -35,7 +78,12 @@ func SetRetries(n int) {
 	defaultPorter.SetRetries(n)
 }
 
-// download
-func Download() {
-	defaultPorter.Download()
+// set porter retries, backoff and retryable statuses
+func SetRetryPolicy(policy httplib.RetryPolicy) {
+	defaultPorter.SetRetryPolicy(policy)
+}
+
+// download, the error of the last attempt is returned when all retries fail
+func Download() error {
+	return defaultPorter.Download()
 }
\ No newline at end of file
@@ -16,7 +16,7 @@ require (
 	github.com/cheggaaa/pb v2.0.6+incompatible
 	github.com/mattn/go-colorable v0.1.2 // indirect
 	golang.org/x/text v0.0.0-20170627122817-6353ef0f9243 // indirect
-	golang.org/x/time v0.0.0-20170424234030-8be79e1e0910 // indirect
+	golang.org/x/time v0.0.0-20170424234030-8be79e1e0910
 	gopkg.in/VividCortex/ewma.v1 v1.1.1 // indirect
 	gopkg.in/cheggaaa/pb.v2 v2.0.6 // indirect
 	gopkg.in/fatih/color.v1 v1.7.0 // indirect
@@ -20,6 +20,7 @@ import (
 	"net"
 	"net/http/httputil"
 	"compress/gzip"
+	"context"
 )
 
 var defaultSetting = HttpSettings {
@@ -28,6 +29,7 @@ var defaultSetting = HttpSettings {
 	ReadWriteTimeout:   60 * time.Second,
 	Gzip: 				true,
 	DumpBody:           true,
+	RetryPolicy:        DefaultRetryPolicy(),
 }
 
 var defaultCookieJar http.CookieJar
@@ -47,6 +49,13 @@ func SetDefaultSetting(setting HttpSettings) {
 	defaultSetting = setting
 }
 
+// GetDefaultSetting returns the settings new requests start with
+func GetDefaultSetting() HttpSettings {
+	settingMutex.Lock()
+	defer settingMutex.Unlock()
+	return defaultSetting
+}
+
 // NewHttpRequest return *HttpRequest with specific method
 func NewHttpRequest(rawurl, method string) *HttpRequest {
 	var resp http.Response
@@ -102,6 +111,8 @@ type HttpSettings struct {
 	ShowDebug			bool
 	UserAgent			string
 	ConnectTimeout 		time.Duration
+	// ReadWriteTimeout is the idle timeout of connections dialed by TimeoutDialer, which a
+	// caller's *http.Transport only gets when it has neither Dial nor DialContext
 	ReadWriteTimeout	time.Duration
 	TLSClientConfig		*tls.Config
 	Proxy 				func(*http.Request) (*url.URL, error)
@@ -111,6 +122,9 @@ type HttpSettings struct {
 	Gzip 				bool
 	DumpBody 			bool
 	Retries 			int   // if set to -1 means will retry forever
+	// RetryPolicy decides the backoff and the retryable statuses, the retries are
+	// counted by Retries
+	RetryPolicy			RetryPolicy
 }
 
 // HttpRequest provides more useful methods for requesting one url than http.Request.
@@ -130,6 +144,13 @@ func (r *HttpRequest) GetRequest() *http.Request {
 	return r.req
 }
 
+// WithContext sets the context of the request, canceling ctx aborts the request
+// and the retries of DoRequest
+func (r *HttpRequest) WithContext(ctx context.Context) *HttpRequest {
+	r.req = r.req.WithContext(ctx)
+	return r
+}
+
 // Setting Change request settings
 func (r *HttpRequest) Setting(setting HttpSettings) *HttpRequest {
 	r.setting = setting
@@ -174,6 +195,13 @@ func (r *HttpRequest)Retries(times int) *HttpRequest {
 	return r
 }
 
+// SetRetryPolicy sets the retries, backoff and retryable statuses of the request
+func (r *HttpRequest) SetRetryPolicy(policy RetryPolicy) *HttpRequest {
+	r.setting.RetryPolicy = policy
+	r.setting.Retries = policy.Retries
+	return r
+}
+
 // DumpBody setting whenther need to Dump the Body.
 func (r *HttpRequest) DumpBody(isdump bool) *HttpRequest {
 	r.setting.DumpBody = isdump
@@ -444,7 +472,8 @@ func (r *HttpRequest) DoRequest() (resp *http.Response, err error) {
 			if t.Proxy == nil {
 				t.Proxy = r.setting.Proxy
 			}
-			if t.Dial == nil {
+			// a caller's DialContext is used as is, without the idle timeout
+			if t.Dial == nil && t.DialContext == nil {
 				t.Dial = TimeoutDialer(r.setting.ConnectTimeout, r.setting.ReadWriteTimeout)
 			}
 		}
@@ -482,11 +511,35 @@ func (r *HttpRequest) DoRequest() (resp *http.Response, err error) {
 	// retries default value is 0, it will run once.
 	// retries equal to -1, it will run forever until success
 	// retries is setted, it will retries fixed times.
-	for i := 0; r.setting.Retries == -1 || i <= r.setting.Retries; i++ {
+	// errors and retryable statuses are retried after the delay of the policy,
+	// other statuses are returned at once
+	ctx := r.req.Context()
+	policy := r.setting.RetryPolicy
+	policy.Retries = r.setting.Retries
+	for attempt := 1; ; attempt++ {
 		resp, err = client.Do(r.req)
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		var retryAfter time.Duration
 		if err == nil {
+			if !policy.RetryStatus(resp.StatusCode) {
+				break
+			}
+			retryAfter, _ = ParseRetryAfter(resp.Header)
+		}
+		if !policy.CanRetry(attempt) {
 			break
 		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := Sleep(ctx, policy.Delay(attempt, retryAfter)); err != nil {
+			return nil, err
+		}
 	}
 	return resp, err
 }
@@ -576,13 +629,37 @@ func (r *HttpRequest) Response() (*http.Response, error) {
 
 
 // TimeoutDialer returs functions of connection dialer with timeout settings for http.Transport Dial field.
+// rwTimeout is an idle timeout, a read or write fails when it makes no progress for that long,
+// so slow transfers keep going as long as bytes arrive. 0 means no timeout
 func TimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
 	return func(netw, addr string) (net.Conn, error) {
 		conn, err := net.DialTimeout(netw, addr, cTimeout)
 		if err != nil {
 			return nil, err
 		}
-		err = conn.SetDeadline(time.Now().Add(rwTimeout))
-		return conn, err
+		if rwTimeout <= 0 {
+			return conn, nil
+		}
+		return &idleConn{Conn: conn, timeout: rwTimeout}, nil
+	}
+}
+
+// idleConn moves the deadline of a connection forward before every read and write
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
 	}
+	return c.Conn.Write(b)
 }
@@ -4,10 +4,12 @@ import (
 	"testing"
 	"strings"
 	"net/http"
+	"net/http/httptest"
 	"net"
 	"time"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 func TestResponse(t *testing.T) {
@@ -164,13 +166,17 @@ func TestToJson(t *testing.T) {
 }
 
 func TestToFile(t *testing.T) {
-	f := "ghttpload_testfile"
+	dir, err := ioutil.TempDir("", "ghttpload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "ghttpload_testfile")
 	req := Get("http://httpbin.org/ip")
-	err := req.ToFile(f)
+	err = req.ToFile(f)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.Remove(f)
 	b, err := ioutil.ReadFile(f)
 	if n := strings.Index(string(b), "origin"); n == -1 {
 		t.Fatal(err)
@@ -186,3 +192,34 @@ func TestHeader(t *testing.T) {
 	}
 	t.Log(str)
 }
+
+func TestIdleTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pause, _ := time.ParseDuration(r.URL.Query().Get("pause"))
+		for i := 0; i < 6; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(pause):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	// earlier tests may leave a default transport with its own DialContext
+	setting := HttpSettings{ConnectTimeout: time.Second, ReadWriteTimeout: 150 * time.Millisecond}
+	req := func(pause string) *HttpRequest {
+		r := Get(ts.URL + "?pause=" + pause)
+		r.Setting(setting)
+		return r
+	}
+	// 300ms in total, but never idle for 150ms
+	if s, err := req("50ms").String(); err != nil || len(s) != 30 {
+		t.Fatalf("got %q, %v", s, err)
+	}
+	if _, err := req("300ms").String(); err == nil {
+		t.Fatal("stalled response didn't time out")
+	}
+}
@@ -0,0 +1,108 @@
+package httplib
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides whether a failed request is tried again and how long to wait before it
+type RetryPolicy struct {
+	// Retries is how many times a request is retried after the first attempt,
+	// -1 means retry forever
+	Retries int
+	// BaseDelay is the wait before the first retry, it doubles with every retry
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between retries, 0 means no cap
+	MaxDelay time.Duration
+	// Jitter randomizes every wait by up to this fraction, 0.2 means ±20%
+	Jitter float64
+	// Retryable reports whether a response status is worth retrying,
+	// nil retries 408, 429 and 5xx
+	Retryable func(status int) bool
+}
+
+// DefaultRetryPolicy returns a policy backing off from 1s up to 30s with 20% jitter
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		BaseDelay: time.Second,
+		MaxDelay:  30 * time.Second,
+		Jitter:    0.2,
+	}
+}
+
+// CanRetry reports whether another attempt is allowed after attempts have been made
+func (p RetryPolicy) CanRetry(attempts int) bool {
+	return p.Retries == -1 || attempts <= p.Retries
+}
+
+// RetryStatus reports whether a response with status should be retried
+func (p RetryPolicy) RetryStatus(status int) bool {
+	if p.Retryable != nil {
+		return p.Retryable(status)
+	}
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// Delay returns the wait after attempt has failed. A positive retryAfter
+// sent by the server is used up to MaxDelay, otherwise the delay backs off exponentially
+func (p RetryPolicy) Delay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if p.MaxDelay > 0 && retryAfter > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return retryAfter
+	}
+	d := p.BaseDelay
+	for i := 1; i < attempt && d > 0 && d < math.MaxInt64/2; i++ {
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+		d *= 2
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// ParseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func ParseRetryAfter(h http.Header) (time.Duration, bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(t); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// Sleep pauses for d, it returns early with ctx.Err() when ctx is done
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,96 @@
+package httplib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 100: 5 * time.Second} {
+		if d := p.Delay(attempt, 0); d != want {
+			t.Errorf("attempt %d: got delay %v, want %v", attempt, d, want)
+		}
+	}
+	if d := p.Delay(1, 3*time.Second); d != 3*time.Second {
+		t.Errorf("got delay %v, want Retry-After of 3s", d)
+	}
+	// a day long Retry-After doesn't hold the request past the cap
+	if d := p.Delay(1, 24*time.Hour); d != p.MaxDelay {
+		t.Errorf("got delay %v, want the cap of %v", d, p.MaxDelay)
+	}
+	if d := (RetryPolicy{}).Delay(1, time.Minute); d != time.Minute {
+		t.Errorf("got delay %v without a cap, want Retry-After of 1m", d)
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(1, 0); d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+		if d := p.Delay(100, 0); d < 2500*time.Millisecond || d > p.MaxDelay {
+			t.Fatalf("jittered delay %v above the cap", d)
+		}
+	}
+}
+
+func TestRetriesField(t *testing.T) {
+	// the retries are counted by Retries, next to the backoff of the policy
+	setting := HttpSettings{Retries: 3}
+	r := Get("http://example.com").Setting(setting).SetRetryPolicy(RetryPolicy{Retries: 1})
+	if r.setting.Retries != 1 {
+		t.Fatalf("got %d retries", r.setting.Retries)
+	}
+}
+
+func TestRetryPolicyRetry(t *testing.T) {
+	p := RetryPolicy{Retries: 2}
+	if !p.CanRetry(2) || p.CanRetry(3) {
+		t.Error("2 retries must allow 3 attempts")
+	}
+	if p.Retries = -1; !p.CanRetry(1000) {
+		t.Error("-1 must retry forever")
+	}
+	for status, want := range map[int]bool{404: false, 403: false, 408: true, 429: true, 500: true, 503: true} {
+		if p.RetryStatus(status) != want {
+			t.Errorf("status %d retryable %v, want %v", status, !want, want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	h := http.Header{}
+	if _, ok := ParseRetryAfter(h); ok {
+		t.Error("missing header parsed")
+	}
+	h.Set("Retry-After", "120")
+	if d, ok := ParseRetryAfter(h); !ok || d != 2*time.Minute {
+		t.Errorf("got %v %v, want 2m", d, ok)
+	}
+	h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d, ok := ParseRetryAfter(h); !ok || d < 59*time.Minute || d > time.Hour {
+		t.Errorf("got %v %v, want about 1h", d, ok)
+	}
+}
+
+func TestRetryAfterCapped(t *testing.T) {
+	var hits int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits++; hits == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	start := time.Now()
+	s, err := Get(ts.URL).SetRetryPolicy(RetryPolicy{Retries: 1, MaxDelay: 50 * time.Millisecond}).String()
+	if err != nil || s != "ok" {
+		t.Fatalf("got %q %v", s, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("waited %v for Retry-After of a day", d)
+	}
+}
@@ -0,0 +1,445 @@
+// Package manager runs many downloads at once on top of porter.Porter,
+// with an overall and a per-host concurrency limit
+package manager
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supeanut/ghttpload/httplib"
+	"github.com/supeanut/ghttpload/porter"
+)
+
+// Option configures the porter of a job before it starts
+type Option func(p *porter.Porter)
+
+// Retries sets porter retries, -1 means retry forever
+func Retries(n int) Option {
+	return func(p *porter.Porter) {
+		p.SetRetries(n)
+	}
+}
+
+// RetryPolicy sets the retries, backoff and retryable statuses of the porter
+func RetryPolicy(policy httplib.RetryPolicy) Option {
+	return func(p *porter.Porter) {
+		p.SetRetryPolicy(policy)
+	}
+}
+
+// Connections sets the parallel connections of one download
+func Connections(n int) Option {
+	return func(p *porter.Porter) {
+		p.SetConnections(n)
+	}
+}
+
+// Checksum sets the expected digest of the file
+func Checksum(algo, hex string) Option {
+	return func(p *porter.Porter) {
+		p.SetChecksum(algo, hex)
+	}
+}
+
+// Header adds a header sent with every request of the job
+func Header(key, value string) Option {
+	return func(p *porter.Porter) {
+		p.SetHeader(key, value)
+	}
+}
+
+// Variant chooses the stream of an HLS master playlist by resolution and highest bits per second
+func Variant(resolution string, maxBandwidth int64) Option {
+	return func(p *porter.Porter) {
+		p.SetVariant(resolution, maxBandwidth)
+	}
+}
+
+// Video chooses the video representation of a DASH manifest by codecs and highest bits per second
+func Video(codecs string, maxBandwidth int64) Option {
+	return func(p *porter.Porter) {
+		p.SetVideo(codecs, maxBandwidth)
+	}
+}
+
+// Audio chooses the audio representation of a DASH manifest by codecs and highest bits per second
+func Audio(codecs string, maxBandwidth int64) Option {
+	return func(p *porter.Porter) {
+		p.SetAudio(codecs, maxBandwidth)
+	}
+}
+
+// Metalink downloads a file of a Metalink document, with its mirrors, size and hashes.
+// URLs in one of locations are preferred
+func Metalink(f porter.MetalinkFile, locations ...string) Option {
+	return func(p *porter.Porter) {
+		p.SetMetalink(f, locations...)
+	}
+}
+
+// Sync downloads a file again only when the server reports a change since the last sync
+func Sync() Option {
+	return func(p *porter.Porter) {
+		p.SetSync(true)
+	}
+}
+
+// RateLimit limits the speed of one download in bytes per second
+func RateLimit(bytesPerSec int64) Option {
+	return func(p *porter.Porter) {
+		p.SetRateLimit(bytesPerSec)
+	}
+}
+
+// MinSpeed reissues requests of one download which stay below bytesPerSec for window
+func MinSpeed(bytesPerSec int64, window time.Duration) Option {
+	return func(p *porter.Porter) {
+		p.SetMinSpeed(bytesPerSec, window)
+	}
+}
+
+// Job describes one download
+type Job struct {
+	Url string
+	// Mirrors serve the same file as Url, segments are spread across them
+	// and they take over when Url fails
+	Mirrors  []string
+	Path     string
+	Filename string
+	Options  []Option
+}
+
+// Status is the state of a task in the manager
+type Status int
+
+const (
+	StatusQueued Status = iota
+	StatusRunning
+	StatusCompleted
+	StatusFailed
+	StatusCanceled
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusQueued:
+		return "queued"
+	case StatusRunning:
+		return "running"
+	case StatusCompleted:
+		return "completed"
+	case StatusFailed:
+		return "failed"
+	case StatusCanceled:
+		return "canceled"
+	}
+	return "unknown"
+}
+
+// TaskStatus is a snapshot of a task
+type TaskStatus struct {
+	Status Status
+	// Written and Total are the bytes of the download, Total is 0 before it starts
+	// and -1 when the server doesn't tell the size
+	Written int64
+	Total   int64
+	// Path is the final path of the file once the download is completed
+	Path string
+	// Duration is how long the task has been running
+	Duration time.Duration
+	// Mirrors tells how many bytes came from Url and from each mirror
+	Mirrors []porter.MirrorStat
+	// Segments tells how often ranges were split or taken over between connections
+	Segments porter.SegmentStats
+	// Unchanged is true when a sync found the file on disk current
+	Unchanged bool
+	Err       error
+}
+
+// Task is a job added to the manager
+type Task struct {
+	ID  int
+	Job Job
+
+	manager   *Manager
+	host      string
+	status    Status
+	path      string
+	mirrors   []porter.MirrorStat
+	segments  porter.SegmentStats
+	unchanged bool
+	err       error
+	cancel    context.CancelFunc
+	done      chan struct{}
+	started   time.Time
+	stopped   time.Time
+
+	progress taskProgress
+}
+
+// Status returns a snapshot of the task
+func (t *Task) Status() TaskStatus {
+	t.manager.mu.Lock()
+	defer t.manager.mu.Unlock()
+	var duration time.Duration
+	switch {
+	case !t.stopped.IsZero():
+		duration = t.stopped.Sub(t.started)
+	case !t.started.IsZero():
+		duration = time.Since(t.started)
+	}
+	return TaskStatus{
+		Status:    t.status,
+		Written:   atomic.LoadInt64(&t.progress.written),
+		Total:     atomic.LoadInt64(&t.progress.total),
+		Path:      t.path,
+		Duration:  duration,
+		Mirrors:   t.mirrors,
+		Segments:  t.segments,
+		Unchanged: t.unchanged,
+		Err:       t.err,
+	}
+}
+
+// Wait blocks until the task is completed, failed or canceled and returns its error
+func (t *Task) Wait() error {
+	t.manager.mu.Lock()
+	done := t.done
+	t.manager.mu.Unlock()
+	<-done
+	t.manager.mu.Lock()
+	defer t.manager.mu.Unlock()
+	return t.err
+}
+
+// Cancel stops the task, a running download keeps its partial file for Retry
+func (t *Task) Cancel() {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch t.status {
+	case StatusQueued:
+		m.remove(t)
+		t.status = StatusCanceled
+		t.err = context.Canceled
+		close(t.done)
+		m.cond.Broadcast()
+	case StatusRunning:
+		t.cancel()
+	}
+}
+
+// Retry queues a failed or canceled task again, its download resumes from the partial file
+func (t *Task) Retry() {
+	m := t.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.status != StatusFailed && t.status != StatusCanceled {
+		return
+	}
+	t.status = StatusQueued
+	t.err = nil
+	t.done = make(chan struct{})
+	t.started, t.stopped = time.Time{}, time.Time{}
+	m.queue = append(m.queue, t)
+	m.schedule()
+}
+
+// download fetches the job and returns the final path and the porter for its statistics,
+// which is nil when the job failed before downloading
+func (t *Task) download(ctx context.Context) (string, *porter.Porter, error) {
+	p := porter.NewPorter()
+	p.SetUrl(t.Job.Url)
+	for _, mirror := range t.Job.Mirrors {
+		p.AddMirror(mirror)
+	}
+	path := t.Job.Path
+	if path == "" {
+		path = t.manager.Path
+	}
+	p.SetPath(path)
+	p.SetFilename(t.Job.Filename)
+	p.SetProgress(&t.progress)
+	options := append(append([]Option{}, t.manager.Options...), t.Job.Options...)
+	for _, option := range options {
+		option(p)
+	}
+	if err := p.Extract(); err != nil {
+		return "", nil, err
+	}
+	if err := p.DownloadContext(ctx); err != nil {
+		return "", p, err
+	}
+	path, err := p.OutputPath()
+	return path, p, err
+}
+
+// taskProgress counts the bytes of a task as its porter.ProgressReporter
+type taskProgress struct {
+	written int64
+	total   int64
+}
+
+func (t *taskProgress) Start(total, current int64) {
+	atomic.StoreInt64(&t.total, total)
+	atomic.StoreInt64(&t.written, current)
+}
+
+func (t *taskProgress) Add(n int64) {
+	atomic.AddInt64(&t.written, n)
+}
+
+func (t *taskProgress) Retry(attempt int, err error) {}
+func (t *taskProgress) Complete()                    {}
+func (t *taskProgress) Error(err error)              {}
+
+// Manager runs jobs with an overall and a per-host concurrency limit
+type Manager struct {
+	// Concurrency is the most tasks running at once, 0 or less means no limit
+	Concurrency int
+	// PerHost is the most tasks running at once against one host, 0 or less means no limit
+	PerHost int
+	// Path is the directory of jobs without their own Path
+	Path string
+	// Options are applied to every job before its own options
+	Options []Option
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ctx     context.Context
+	nextID  int
+	tasks   []*Task
+	queue   []*Task
+	running int
+	hosts   map[string]int
+}
+
+// NewManager returns a manager running at most concurrency tasks, and perHost per host
+func NewManager(concurrency, perHost int) *Manager {
+	return NewManagerContext(context.Background(), concurrency, perHost)
+}
+
+// NewManagerContext is like NewManager, canceling ctx cancels every task
+func NewManagerContext(ctx context.Context, concurrency, perHost int) *Manager {
+	m := &Manager{
+		Concurrency: concurrency,
+		PerHost:     perHost,
+		ctx:         ctx,
+		hosts:       map[string]int{},
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// Add queues job and returns its task
+func (m *Manager) Add(job Job) *Task {
+	var host string
+	if u, err := url.Parse(job.Url); err == nil {
+		host = u.Host
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	t := &Task{
+		ID:      m.nextID,
+		Job:     job,
+		manager: m,
+		host:    host,
+		status:  StatusQueued,
+		done:    make(chan struct{}),
+	}
+	m.tasks = append(m.tasks, t)
+	m.queue = append(m.queue, t)
+	m.schedule()
+	return t
+}
+
+// Tasks returns every task added to the manager
+func (m *Manager) Tasks() []*Task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Task{}, m.tasks...)
+}
+
+// Task returns the task with id or nil
+func (m *Manager) Task(id int) *Task {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tasks {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// Wait blocks until no task is queued or running
+func (m *Manager) Wait() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.queue) > 0 || m.running > 0 {
+		m.cond.Wait()
+	}
+}
+
+// schedule starts queued tasks in order while the limits allow, m.mu must be held
+func (m *Manager) schedule() {
+	queue := m.queue[:0]
+	for _, t := range m.queue {
+		if (m.Concurrency > 0 && m.running >= m.Concurrency) ||
+			(m.PerHost > 0 && m.hosts[t.host] >= m.PerHost) {
+			queue = append(queue, t)
+			continue
+		}
+		m.running++
+		m.hosts[t.host]++
+		t.status = StatusRunning
+		t.started = time.Now()
+		var ctx context.Context
+		ctx, t.cancel = context.WithCancel(m.ctx)
+		go m.run(ctx, t)
+	}
+	m.queue = queue
+}
+
+// remove drops t from the queue, m.mu must be held
+func (m *Manager) remove(t *Task) {
+	for i, q := range m.queue {
+		if q == t {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *Manager) run(ctx context.Context, t *Task) {
+	path, p, err := t.download(ctx)
+	canceled := ctx.Err() != nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.cancel()
+	t.stopped = time.Now()
+	m.running--
+	m.hosts[t.host]--
+	t.err = err
+	t.path = path
+	if p != nil {
+		t.mirrors = p.MirrorStats()
+		t.segments = p.SegmentStats()
+		t.unchanged = p.Stream.Unchanged
+	}
+	switch {
+	case err == nil:
+		t.status = StatusCompleted
+	case canceled:
+		t.status = StatusCanceled
+	default:
+		t.status = StatusFailed
+	}
+	close(t.done)
+	m.schedule()
+	m.cond.Broadcast()
+}
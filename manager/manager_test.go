@@ -0,0 +1,186 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	content := bytes.Repeat([]byte("ghttpload"), 1024)
+	var running, maxRunning int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "file", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewManager(4, 1)
+	for i := 0; i < 4; i++ {
+		m.Add(Job{Url: ts.URL + "/file", Path: dir, Filename: "file" + strconv.Itoa(i),
+			Options: []Option{Retries(1)}})
+	}
+	m.Wait()
+	for _, task := range m.Tasks() {
+		s := task.Status()
+		if s.Status != StatusCompleted {
+			t.Fatalf("task %d: %s: %v", task.ID, s.Status, s.Err)
+		}
+		if s.Written != int64(len(content)) {
+			t.Fatalf("task %d: wrote %d bytes", task.ID, s.Written)
+		}
+		b, err := ioutil.ReadFile(s.Path)
+		if err != nil || !bytes.Equal(b, content) {
+			t.Fatalf("task %d: content not match: %v", task.ID, err)
+		}
+	}
+	if maxRunning != 1 {
+		t.Fatalf("%d downloads ran against one host", maxRunning)
+	}
+}
+
+func TestManagerCancelRetry(t *testing.T) {
+	content := bytes.Repeat([]byte("ghttpload"), 1024)
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			<-block
+		}
+		http.ServeContent(w, r, "file", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewManager(1, 0)
+	first := m.Add(Job{Url: ts.URL + "/file", Path: dir, Filename: "first"})
+	second := m.Add(Job{Url: ts.URL + "/file", Path: dir, Filename: "second"})
+	if s := second.Status().Status; s != StatusQueued {
+		t.Fatalf("second task is %s", s)
+	}
+	second.Cancel()
+	for first.Status().Status != StatusRunning {
+		time.Sleep(time.Millisecond)
+	}
+	first.Cancel()
+	if err := first.Wait(); err == nil {
+		t.Fatal("canceled task succeeded")
+	}
+	if s := first.Status().Status; s != StatusCanceled {
+		t.Fatalf("first task is %s", s)
+	}
+
+	close(block)
+	first.Retry()
+	second.Retry()
+	m.Wait()
+	for _, task := range []*Task{first, second} {
+		if s := task.Status(); s.Status != StatusCompleted {
+			t.Fatalf("task %d: %s: %v", task.ID, s.Status, s.Err)
+		}
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	manifest := `{"url": "http://example.com/a.ts", "retries": 3, "checksum": "sha256:00"}
+
+{"url": "ftp://example.com/b.ts"}
+{"url": "http://example.com/c.ts", "checksum": "crc32:00"}
+{"url": "http://example.com/d.ts", "unknown": 1}
+{"url": "http://example.com/e.ts", "mirrors": ["http://mirror.example.com/e.ts"], "headers": {"Referer": "http://example.com"}}`
+	_, err := LoadManifest(strings.NewReader(manifest))
+	errs, ok := err.(ManifestErrors)
+	if !ok {
+		t.Fatalf("got error %v, want ManifestErrors", err)
+	}
+	var lines []int
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	if fmt.Sprint(lines) != "[3 4 5]" {
+		t.Fatalf("errors on lines %v: %v", lines, err)
+	}
+
+	jobs, err := LoadManifest(strings.NewReader(strings.Join(strings.Split(manifest, "\n")[5:], "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || len(jobs[0].Mirrors) != 1 || len(jobs[0].Options) != 1 {
+		t.Fatalf("got jobs %+v", jobs)
+	}
+}
+
+func TestRunManifest(t *testing.T) {
+	content := bytes.Repeat([]byte("ghttpload"), 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manifest := fmt.Sprintf(`{"url": "%[1]s/file", "path": %[2]q, "filename": "one"}
+{"url": "%[1]s/missing", "path": %[2]q, "filename": "two", "mirrors": ["%[1]s/file"]}
+{"url": "%[1]s/missing", "path": %[2]q, "filename": "three"}
+`, ts.URL, dir)
+	var out bytes.Buffer
+	results, err := NewManager(2, 0).RunManifest(strings.NewReader(manifest), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	dec := json.NewDecoder(&out)
+	for {
+		var r Result
+		if err := dec.Decode(&r); err != nil {
+			break
+		}
+		statuses = append(statuses, r.Status)
+	}
+	if fmt.Sprint(statuses) != "[completed completed failed]" {
+		t.Fatalf("got statuses %v", statuses)
+	}
+	if results[1].Bytes != int64(len(content)) || results[1].Path == "" || results[2].Error == "" {
+		t.Fatalf("got results %+v", results)
+	}
+	if results[1].Mirrors[ts.URL+"/file"] != int64(len(content)) {
+		t.Fatalf("got mirror bytes %v", results[1].Mirrors)
+	}
+}
@@ -0,0 +1,227 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/supeanut/ghttpload/porter"
+)
+
+// ManifestEntry is one line of a JSONL manifest
+type ManifestEntry struct {
+	Url      string            `json:"url"`
+	Path     string            `json:"path,omitempty"`
+	Filename string            `json:"filename,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	// Retries -1 means retry forever
+	Retries int `json:"retries,omitempty"`
+	// Checksum is written as "<algo>:<hex>", e.g. "sha256:9f86d0..."
+	Checksum string   `json:"checksum,omitempty"`
+	Mirrors  []string `json:"mirrors,omitempty"`
+}
+
+// ManifestError is a problem found on one line of a manifest
+type ManifestError struct {
+	Line int
+	Err  error
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// ManifestErrors holds every problem found in a manifest
+type ManifestErrors []*ManifestError
+
+func (e ManifestErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Result is written as one JSONL line for each manifest entry after it has run
+type Result struct {
+	Line   int    `json:"line"`
+	Url    string `json:"url"`
+	Status string `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	Path     string  `json:"path,omitempty"`
+	// Mirrors holds the bytes fetched from each URL of an entry with mirrors
+	Mirrors map[string]int64 `json:"mirrors,omitempty"`
+	// Splits is how often a range was split off for an idle connection
+	Splits int `json:"splits,omitempty"`
+	// Unchanged is true when a sync found the file on disk current
+	Unchanged bool   `json:"unchanged,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// MirrorBytes maps each URL of a download to the bytes fetched from it
+func MirrorBytes(stats []porter.MirrorStat) map[string]int64 {
+	m := map[string]int64{}
+	for _, s := range stats {
+		m[s.Url] += s.Bytes
+	}
+	return m
+}
+
+// manifestJob is a job and the line it was read from
+type manifestJob struct {
+	line int
+	job  Job
+}
+
+// LoadManifest parses a JSONL manifest into jobs, blank lines are skipped.
+// Every invalid line is reported in the returned ManifestErrors
+func LoadManifest(r io.Reader) ([]Job, error) {
+	entries, err := loadManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, len(entries))
+	for i, e := range entries {
+		jobs[i] = e.job
+	}
+	return jobs, nil
+}
+
+func loadManifest(r io.Reader) ([]manifestJob, error) {
+	var (
+		jobs []manifestJob
+		errs ManifestErrors
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		job, err := parseManifestLine(b)
+		if err != nil {
+			errs = append(errs, &ManifestError{Line: line, Err: err})
+			continue
+		}
+		jobs = append(jobs, manifestJob{line: line, job: job})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return jobs, nil
+}
+
+func parseManifestLine(b []byte) (Job, error) {
+	var e ManifestEntry
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&e); err != nil {
+		return Job{}, err
+	}
+	for _, u := range append([]string{e.Url}, e.Mirrors...) {
+		if err := validateURL(u); err != nil {
+			return Job{}, err
+		}
+	}
+	if e.Retries < -1 {
+		return Job{}, fmt.Errorf("invalid retries %d", e.Retries)
+	}
+
+	job := Job{Url: e.Url, Mirrors: e.Mirrors, Path: e.Path, Filename: e.Filename}
+	if e.Retries != 0 {
+		job.Options = append(job.Options, Retries(e.Retries))
+	}
+	for k, v := range e.Headers {
+		job.Options = append(job.Options, Header(k, v))
+	}
+	if e.Checksum != "" {
+		i := strings.Index(e.Checksum, ":")
+		if i < 0 {
+			return Job{}, fmt.Errorf("checksum %q is not <algo>:<hex>", e.Checksum)
+		}
+		algo, hex := e.Checksum[:i], e.Checksum[i+1:]
+		if !porter.SupportedChecksum(algo) {
+			return Job{}, fmt.Errorf("unsupported checksum algorithm %q", algo)
+		}
+		job.Options = append(job.Options, Checksum(algo, hex))
+	}
+	return job, nil
+}
+
+func validateURL(rawurl string) error {
+	if rawurl == "" {
+		return fmt.Errorf("missing url")
+	}
+	u, err := url.ParseRequestURI(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// RunManifest downloads every entry of the manifest read from r and writes
+// one Result line per entry to w in manifest order. Nothing is downloaded
+// when the manifest is invalid
+func (m *Manager) RunManifest(r io.Reader, w io.Writer) ([]Result, error) {
+	jobs, err := loadManifest(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.runJobs(jobs, w)
+}
+
+// RunJobs downloads jobs like RunManifest, the Line of each Result is
+// the position of its job counting from 1
+func (m *Manager) RunJobs(jobs []Job, w io.Writer) ([]Result, error) {
+	entries := make([]manifestJob, len(jobs))
+	for i, j := range jobs {
+		entries[i] = manifestJob{line: i + 1, job: j}
+	}
+	return m.runJobs(entries, w)
+}
+
+func (m *Manager) runJobs(jobs []manifestJob, w io.Writer) ([]Result, error) {
+	tasks := make([]*Task, len(jobs))
+	for i, j := range jobs {
+		tasks[i] = m.Add(j.job)
+	}
+	results := make([]Result, len(jobs))
+	enc := json.NewEncoder(w)
+	for i, t := range tasks {
+		t.Wait()
+		s := t.Status()
+		results[i] = Result{
+			Line:     jobs[i].line,
+			Url:      t.Job.Url,
+			Status:   s.Status.String(),
+			Bytes:    s.Written,
+			Duration: s.Duration.Seconds(),
+			Path:     s.Path,
+		}
+		if len(s.Mirrors) > 1 {
+			results[i].Mirrors = MirrorBytes(s.Mirrors)
+		}
+		results[i].Splits = s.Segments.Splits
+		results[i].Unchanged = s.Unchanged
+		if s.Err != nil {
+			results[i].Error = s.Err.Error()
+		}
+		if err := enc.Encode(results[i]); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
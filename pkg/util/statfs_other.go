@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package util
+
+// FreeSpace returns -1 where the free space of a file system can't be read
+func FreeSpace(path string) (int64, error) {
+	return -1, nil
+}
@@ -42,6 +42,27 @@ func FileName(name string) string {
 	return LimitLength(name, MAXLENGTH)
 }
 
+// SafeFileName returns the last element of a name sent by a server,
+// so it can't point outside the download directory. Names which are
+// empty or only dots return ""
+func SafeFileName(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if strings.Trim(name, ".") == "" {
+		return ""
+	}
+	return name
+}
+
 // LimitLength Handle overly long strings
 func LimitLength(s string, length int) string {
 	const ELLIPSES = "..."
@@ -0,0 +1,148 @@
+package porter
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Checksum is the expected digest of a file
+type Checksum struct {
+	// Algo is one of md5, sha1, sha256 and sha512
+	Algo string
+	// Hex is the digest in hex encoding
+	Hex string
+}
+
+// ChecksumError is returned when the downloaded file doesn't match a checksum
+type ChecksumError struct {
+	Algo string
+	Want string
+	Got  string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: want %s, got %s", e.Algo, e.Want, e.Got)
+}
+
+// normalizeAlgo turns names like "SHA-256" into "sha256"
+func normalizeAlgo(algo string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(algo)), "-", "", -1)
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch normalizeAlgo(algo) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+}
+
+// SupportedChecksum reports whether algo can be used with SetChecksum
+func SupportedChecksum(algo string) bool {
+	_, err := newHash(algo)
+	return err == nil
+}
+
+// headerChecksums returns the checksums announced by Digest and Content-MD5 headers,
+// algorithms which aren't supported are skipped
+func headerChecksums(h http.Header) []Checksum {
+	var checksums []Checksum
+	add := func(algo, b64 string) {
+		if _, err := newHash(algo); err != nil {
+			return
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return
+		}
+		checksums = append(checksums, Checksum{Algo: normalizeAlgo(algo), Hex: hex.EncodeToString(b)})
+	}
+	// Digest: SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=,MD5=...
+	for _, v := range h["Digest"] {
+		for _, d := range strings.Split(v, ",") {
+			if i := strings.Index(d, "="); i > 0 {
+				add(d[:i], d[i+1:])
+			}
+		}
+	}
+	if v := h.Get("Content-MD5"); v != "" {
+		add("md5", v)
+	}
+	return checksums
+}
+
+// digester hashes the written bytes with the algorithm of every expected checksum
+type digester struct {
+	checksums []Checksum
+	hashes    map[string]hash.Hash
+	written   int64
+}
+
+// newDigester returns nil when there is nothing to verify
+func newDigester(checksums []Checksum) (*digester, error) {
+	if len(checksums) == 0 {
+		return nil, nil
+	}
+	d := &digester{checksums: checksums, hashes: map[string]hash.Hash{}}
+	for _, c := range checksums {
+		algo := normalizeAlgo(c.Algo)
+		if _, ok := d.hashes[algo]; ok {
+			continue
+		}
+		h, err := newHash(algo)
+		if err != nil {
+			return nil, err
+		}
+		d.hashes[algo] = h
+	}
+	return d, nil
+}
+
+func (d *digester) Write(b []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(b)
+	}
+	d.written += int64(len(b))
+	return len(b), nil
+}
+
+func (d *digester) Reset() {
+	for _, h := range d.hashes {
+		h.Reset()
+	}
+	d.written = 0
+}
+
+// hashFile starts over with the first n bytes of file
+func (d *digester) hashFile(file io.ReaderAt, n int64) error {
+	d.Reset()
+	_, err := io.Copy(d, io.NewSectionReader(file, 0, n))
+	return err
+}
+
+// verify compares the hashes with every expected checksum
+func (d *digester) verify() error {
+	for _, c := range d.checksums {
+		algo := normalizeAlgo(c.Algo)
+		got := hex.EncodeToString(d.hashes[algo].Sum(nil))
+		if !strings.EqualFold(got, strings.TrimSpace(c.Hex)) {
+			return &ChecksumError{Algo: algo, Want: c.Hex, Got: got}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package porter
+
+import (
+	"context"
+	"sync"
+)
+
+// State is the lifecycle state of a Porter
+type State int32
+
+const (
+	StateIdle State = iota
+	StateRunning
+	StatePaused
+	StateCompleted
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateCompleted:
+		return "completed"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// control holds the state of a running download, it is safe for concurrent use
+type control struct {
+	mu     sync.Mutex
+	state  State
+	cancel context.CancelFunc
+	resume chan struct{}
+}
+
+// State returns the current state of the download
+func (p *Porter) State() State {
+	p.control.mu.Lock()
+	defer p.control.mu.Unlock()
+	return p.control.state
+}
+
+// Pause stops a running download after the written bytes are flushed to disk,
+// the Download call keeps blocking until Resume is called
+func (p *Porter) Pause() {
+	c := &p.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != StateRunning {
+		return
+	}
+	c.state = StatePaused
+	c.resume = make(chan struct{})
+	c.cancel()
+}
+
+// Resume continues a paused download from where it stopped
+func (p *Porter) Resume() {
+	c := &p.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != StatePaused {
+		return
+	}
+	c.state = StateRunning
+	close(c.resume)
+}
+
+// start marks the download running, canceling the returned context pauses it
+func (p *Porter) start(ctx context.Context) context.Context {
+	c := &p.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctx, c.cancel = context.WithCancel(ctx)
+	if c.state != StatePaused {
+		c.state = StateRunning
+	}
+	return ctx
+}
+
+// wait blocks a paused download until it is resumed, false means it wasn't paused
+func (p *Porter) wait(ctx context.Context) (bool, error) {
+	c := &p.control
+	c.mu.Lock()
+	resume := c.resume
+	paused := c.state == StatePaused
+	c.mu.Unlock()
+	if !paused {
+		return false, nil
+	}
+	select {
+	case <-resume:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// stop records the final state of the download
+func (p *Porter) stop(err error) {
+	c := &p.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancel()
+	if err != nil {
+		c.state = StateFailed
+	} else {
+		c.state = StateCompleted
+	}
+}
@@ -0,0 +1,704 @@
+package porter
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/supeanut/ghttpload/pkg/util"
+)
+
+// RepresentationSelect chooses a representation of a DASH manifest,
+// the highest bandwidth is chosen when nothing is set
+type RepresentationSelect struct {
+	// Codecs picks representations whose codecs start with it, like "avc1" or "mp4a"
+	Codecs string
+	// MaxBandwidth picks the best representation within this many bits per second,
+	// or the lowest one when none fits
+	MaxBandwidth int64
+}
+
+// Representation is one stream of a DASH manifest
+type Representation struct {
+	ID string
+	// ContentType is "video" or "audio"
+	ContentType string
+	MimeType    string
+	Codecs      string
+	// Bandwidth is in bits per second
+	Bandwidth     int64
+	Width, Height int
+	// Filename is the file the representation is saved to
+	Filename string
+	// Segments are in playback order, the init segment of every period comes first
+	Segments []MediaSegment
+}
+
+// Manifest is a DASH manifest and the representations picked from it
+type Manifest struct {
+	Url string
+	// Representations holds one video and one audio representation at most
+	Representations []Representation
+}
+
+// mimeExts maps the mime type of a representation to the extension of its file
+var mimeExts = map[string]string{
+	"video/mp4":  "mp4",
+	"audio/mp4":  "m4a",
+	"video/webm": "webm",
+	"audio/webm": "weba",
+}
+
+type mpd struct {
+	Type     string      `xml:"type,attr"`
+	Duration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL  []string    `xml:"BaseURL"`
+	Periods  []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Start          string             `xml:"start,attr"`
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        []string           `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+// mpdSegmentInfo is how the segments of an adaptation set or representation are listed
+type mpdSegmentInfo struct {
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType string   `xml:"contentType,attr"`
+	MimeType    string   `xml:"mimeType,attr"`
+	Codecs      string   `xml:"codecs,attr"`
+	BaseURL     []string `xml:"BaseURL"`
+	mpdSegmentInfo
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID        string   `xml:"id,attr"`
+	Bandwidth int64    `xml:"bandwidth,attr"`
+	Width     int      `xml:"width,attr"`
+	Height    int      `xml:"height,attr"`
+	MimeType  string   `xml:"mimeType,attr"`
+	Codecs    string   `xml:"codecs,attr"`
+	BaseURL   []string `xml:"BaseURL"`
+	mpdSegmentInfo
+}
+
+type mpdSegmentTemplate struct {
+	Media          string       `xml:"media,attr"`
+	Initialization string       `xml:"initialization,attr"`
+	StartNumber    *int64       `xml:"startNumber,attr"`
+	Timescale      *int64       `xml:"timescale,attr"`
+	Duration       *int64       `xml:"duration,attr"`
+	Timeline       *mpdTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdTimeline struct {
+	S []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+type mpdSegmentList struct {
+	Initialization *mpdURL `xml:"Initialization"`
+	SegmentURLs    []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+type mpdSegmentBase struct {
+	Initialization *mpdURL `xml:"Initialization"`
+}
+
+// SetVideo sets how the video representation of a DASH manifest is chosen
+func (p *Porter) SetVideo(codecs string, maxBandwidth int64) {
+	p.Video = RepresentationSelect{Codecs: codecs, MaxBandwidth: maxBandwidth}
+}
+
+// SetAudio sets how the audio representation of a DASH manifest is chosen
+func (p *Porter) SetAudio(codecs string, maxBandwidth int64) {
+	p.Audio = RepresentationSelect{Codecs: codecs, MaxBandwidth: maxBandwidth}
+}
+
+// isDASH reports whether a HEAD response is a DASH manifest
+func isDASH(resp *http.Response) bool {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if strings.EqualFold(t, "application/dash+xml") {
+		return true
+	}
+	return resp.Request != nil && resp.Request.URL != nil &&
+		strings.EqualFold(path.Ext(resp.Request.URL.Path), ".mpd")
+}
+
+// extractDASH reads the manifest of the stream and picks its representations
+func (p *Porter) extractDASH(ctx context.Context) error {
+	u := p.headURL()
+	data, base, err := p.fetchPlaylist(ctx, u)
+	if err != nil {
+		return err
+	}
+	reps, err := parseManifest(data, base, map[string]RepresentationSelect{"video": p.Video, "audio": p.Audio})
+	if err != nil {
+		return fmt.Errorf("%s: %v", u, err)
+	}
+	p.Stream.Manifest = &Manifest{Url: u, Representations: reps}
+	// the size and checksums of the HEAD response describe the manifest
+	p.Stream.URL.Size, p.Stream.Size = -1, -1
+	p.Stream.URL.Checksums = nil
+	return nil
+}
+
+// nameRepresentations names the file of every representation after name,
+// like name.video.mp4 and name.audio.m4a
+func (m *Manifest) nameRepresentations(name string) {
+	for i := range m.Representations {
+		r := &m.Representations[i]
+		ext, ok := mimeExts[strings.ToLower(r.MimeType)]
+		if !ok {
+			ext = "mp4"
+		}
+		r.Filename = fmt.Sprintf("%s.%s.%s", name, r.ContentType, ext)
+	}
+}
+
+// segments returns the segments of every representation one after another,
+// their ids carry the representation ID
+func (m *Manifest) segments() ([]MediaSegment, []string) {
+	var segments []MediaSegment
+	var ids []string
+	for _, r := range m.Representations {
+		for _, s := range r.Segments {
+			segments = append(segments, s)
+			ids = append(ids, r.ID+" "+segmentID(s))
+		}
+	}
+	return segments, ids
+}
+
+// parseManifest parses an MPD and returns the video and audio representation chosen by
+// selects for every period, segments of later periods are appended. URLs are resolved against base
+func parseManifest(data []byte, base *url.URL, selects map[string]RepresentationSelect) ([]Representation, error) {
+	var m mpd
+	if err := xml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("not a DASH manifest: %v", err)
+	}
+	if m.Type == "dynamic" {
+		return nil, fmt.Errorf("live DASH manifests are not supported")
+	}
+	if len(m.Periods) == 0 {
+		return nil, fmt.Errorf("manifest has no periods")
+	}
+	base, err := resolveBase(base, m.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	total, _ := parseISODuration(m.Duration)
+	var reps []Representation
+	initIDs := map[string]string{}
+	for i, period := range m.Periods {
+		duration, err := periodDuration(m, i, total)
+		if err != nil {
+			return nil, err
+		}
+		periodBase, err := resolveBase(base, period.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		for _, contentType := range []string{"video", "audio"} {
+			set, rep, ok := pickRepresentation(period, contentType, selects[contentType])
+			if !ok {
+				continue
+			}
+			segments, err := representationSegments(periodBase, set, rep, duration)
+			if err != nil {
+				return nil, fmt.Errorf("representation %s: %v", rep.ID, err)
+			}
+			var r *Representation
+			for j := range reps {
+				if reps[j].ContentType == contentType {
+					r = &reps[j]
+				}
+			}
+			if r == nil {
+				reps = append(reps, Representation{
+					ID:          rep.ID,
+					ContentType: contentType,
+					MimeType:    firstNonEmpty(rep.MimeType, set.MimeType),
+					Codecs:      firstNonEmpty(rep.Codecs, set.Codecs),
+					Bandwidth:   rep.Bandwidth,
+					Width:       rep.Width,
+					Height:      rep.Height,
+				})
+				r = &reps[len(reps)-1]
+			}
+			for j, s := range segments {
+				if j == 0 && s.init {
+					// an init segment is written again only when it changes between periods
+					id := fmt.Sprint(s.Url, s.Range)
+					if id == initIDs[contentType] {
+						continue
+					}
+					initIDs[contentType] = id
+				}
+				r.Segments = append(r.Segments, s.MediaSegment)
+			}
+		}
+	}
+	if len(reps) == 0 {
+		return nil, fmt.Errorf("manifest has no video or audio representations")
+	}
+	return reps, nil
+}
+
+// periodDuration returns the length of period i in seconds, 0 when unknown
+func periodDuration(m mpd, i int, total float64) (float64, error) {
+	period := m.Periods[i]
+	if period.Duration != "" {
+		return parseISODuration(period.Duration)
+	}
+	start, err := parseISODuration(period.Start)
+	if err != nil {
+		return 0, err
+	}
+	end := total
+	if i+1 < len(m.Periods) && m.Periods[i+1].Start != "" {
+		if end, err = parseISODuration(m.Periods[i+1].Start); err != nil {
+			return 0, err
+		}
+	}
+	if end <= start {
+		return 0, nil
+	}
+	return end - start, nil
+}
+
+// pickRepresentation returns the representation of contentType matching s in period
+func pickRepresentation(period mpdPeriod, contentType string, s RepresentationSelect) (mpdAdaptationSet, mpdRepresentation, bool) {
+	type candidate struct {
+		set mpdAdaptationSet
+		rep mpdRepresentation
+	}
+	var candidates, matching []candidate
+	for _, set := range period.AdaptationSets {
+		for _, rep := range set.Representations {
+			if representationType(set, rep) != contentType {
+				continue
+			}
+			c := candidate{set, rep}
+			candidates = append(candidates, c)
+			if s.Codecs != "" && hasCodec(firstNonEmpty(rep.Codecs, set.Codecs), s.Codecs) {
+				matching = append(matching, c)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return mpdAdaptationSet{}, mpdRepresentation{}, false
+	}
+	if len(matching) > 0 {
+		candidates = matching
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rep.Bandwidth > candidates[j].rep.Bandwidth
+	})
+	pick := candidates[0]
+	if s.MaxBandwidth > 0 {
+		pick = candidates[len(candidates)-1]
+		for _, c := range candidates {
+			if c.rep.Bandwidth <= s.MaxBandwidth {
+				pick = c
+				break
+			}
+		}
+	}
+	return pick.set, pick.rep, true
+}
+
+// representationType returns "video", "audio" or another content type of rep
+func representationType(set mpdAdaptationSet, rep mpdRepresentation) string {
+	if set.ContentType != "" {
+		return strings.ToLower(set.ContentType)
+	}
+	t := firstNonEmpty(rep.MimeType, set.MimeType)
+	if i := strings.Index(t, "/"); i > 0 {
+		return strings.ToLower(t[:i])
+	}
+	return ""
+}
+
+// hasCodec reports whether one of the comma separated codecs starts with prefix
+func hasCodec(codecs, prefix string) bool {
+	for _, c := range strings.Split(codecs, ",") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(c)), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dashSegment is a media segment and whether it is the init segment
+type dashSegment struct {
+	MediaSegment
+	init bool
+}
+
+// representationSegments lists the segments of rep, duration is the length of the period in seconds
+func representationSegments(base *url.URL, set mpdAdaptationSet, rep mpdRepresentation, duration float64) ([]dashSegment, error) {
+	base, err := resolveBase(base, set.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base, err = resolveBase(base, rep.BaseURL); err != nil {
+		return nil, err
+	}
+	switch {
+	case rep.SegmentTemplate != nil || set.SegmentTemplate != nil:
+		return templateSegments(base, mergeTemplates(set.SegmentTemplate, rep.SegmentTemplate), rep, duration)
+	case rep.SegmentList != nil || set.SegmentList != nil:
+		list := rep.SegmentList
+		if list == nil {
+			list = set.SegmentList
+		}
+		return listSegments(base, list)
+	}
+	// SegmentBase or a plain BaseURL, the whole file is one segment
+	segments := []dashSegment{{MediaSegment: MediaSegment{Url: base.String()}}}
+	sb := rep.SegmentBase
+	if sb == nil {
+		sb = set.SegmentBase
+	}
+	if sb != nil && sb.Initialization != nil && sb.Initialization.SourceURL != "" {
+		init, err := initSegment(base, sb.Initialization)
+		if err != nil {
+			return nil, err
+		}
+		segments = append([]dashSegment{init}, segments...)
+	}
+	return segments, nil
+}
+
+// mergeTemplates returns the template of a representation with the attributes
+// it doesn't set taken from the template of its adaptation set
+func mergeTemplates(set, rep *mpdSegmentTemplate) mpdSegmentTemplate {
+	var t mpdSegmentTemplate
+	if set != nil {
+		t = *set
+	}
+	if rep == nil {
+		return t
+	}
+	if rep.Media != "" {
+		t.Media = rep.Media
+	}
+	if rep.Initialization != "" {
+		t.Initialization = rep.Initialization
+	}
+	if rep.StartNumber != nil {
+		t.StartNumber = rep.StartNumber
+	}
+	if rep.Timescale != nil {
+		t.Timescale = rep.Timescale
+	}
+	if rep.Duration != nil {
+		t.Duration = rep.Duration
+	}
+	if rep.Timeline != nil {
+		t.Timeline = rep.Timeline
+	}
+	return t
+}
+
+// templateSegments expands a SegmentTemplate, either from its SegmentTimeline
+// or from the segment duration and the length of the period
+func templateSegments(base *url.URL, t mpdSegmentTemplate, rep mpdRepresentation, duration float64) ([]dashSegment, error) {
+	if t.Media == "" {
+		return nil, fmt.Errorf("SegmentTemplate has no media")
+	}
+	number, timescale := int64(1), int64(1)
+	if t.StartNumber != nil {
+		number = *t.StartNumber
+	}
+	if t.Timescale != nil && *t.Timescale > 0 {
+		timescale = *t.Timescale
+	}
+	var segments []dashSegment
+	add := func(tmpl string, number, time int64, init bool) error {
+		u, err := resolveURL(base, expandTemplate(tmpl, rep, number, time))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, dashSegment{MediaSegment{Url: u}, init})
+		return nil
+	}
+	if t.Initialization != "" {
+		if err := add(t.Initialization, 0, 0, true); err != nil {
+			return nil, err
+		}
+	}
+	if t.Timeline != nil {
+		end := int64(math.Ceil(duration * float64(timescale)))
+		var time int64
+		for i, s := range t.Timeline.S {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.D <= 0 {
+				return nil, fmt.Errorf("SegmentTimeline has a segment without duration")
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// repeat until the next S or the end of the period
+				until := end
+				if i+1 < len(t.Timeline.S) && t.Timeline.S[i+1].T != nil {
+					until = *t.Timeline.S[i+1].T
+				}
+				if until <= time {
+					return nil, fmt.Errorf("SegmentTimeline repeats to an unknown end")
+				}
+				repeat = (until-time+s.D-1)/s.D - 1
+			}
+			for r := int64(0); r <= repeat; r++ {
+				if err := add(t.Media, number, time, false); err != nil {
+					return nil, err
+				}
+				number++
+				time += s.D
+			}
+		}
+		return segments, nil
+	}
+	if t.Duration == nil || *t.Duration <= 0 {
+		return nil, fmt.Errorf("SegmentTemplate has neither SegmentTimeline nor duration")
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("the length of the period is unknown")
+	}
+	count := int64(math.Ceil(duration * float64(timescale) / float64(*t.Duration)))
+	for i := int64(0); i < count; i++ {
+		if err := add(t.Media, number+i, i**t.Duration, false); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// templateVar matches the identifiers of a SegmentTemplate like $Number%05d$
+var templateVar = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time|)(%0(\d+)d)?\$`)
+
+// expandTemplate replaces the identifiers of tmpl
+func expandTemplate(tmpl string, rep mpdRepresentation, number, time int64) string {
+	return templateVar.ReplaceAllStringFunc(tmpl, func(s string) string {
+		m := templateVar.FindStringSubmatch(s)
+		var v int64
+		switch m[1] {
+		case "":
+			return "$"
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			v = number
+		case "Bandwidth":
+			v = rep.Bandwidth
+		case "Time":
+			v = time
+		}
+		if m[3] != "" {
+			width, _ := strconv.Atoi(m[3])
+			return fmt.Sprintf("%0*d", width, v)
+		}
+		return strconv.FormatInt(v, 10)
+	})
+}
+
+// listSegments returns the segments of a SegmentList
+func listSegments(base *url.URL, list *mpdSegmentList) ([]dashSegment, error) {
+	var segments []dashSegment
+	if list.Initialization != nil {
+		init, err := initSegment(base, list.Initialization)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, init)
+	}
+	for _, su := range list.SegmentURLs {
+		u, err := resolveURL(base, su.Media)
+		if err != nil {
+			return nil, err
+		}
+		s := MediaSegment{Url: u}
+		if su.MediaRange != "" {
+			if s.Range, err = parseRange(su.MediaRange); err != nil {
+				return nil, err
+			}
+		}
+		segments = append(segments, dashSegment{MediaSegment: s})
+	}
+	return segments, nil
+}
+
+// initSegment returns the segment of an Initialization element
+func initSegment(base *url.URL, init *mpdURL) (dashSegment, error) {
+	u, err := resolveURL(base, init.SourceURL)
+	if err != nil {
+		return dashSegment{}, err
+	}
+	s := dashSegment{MediaSegment: MediaSegment{Url: u}, init: true}
+	if init.Range != "" {
+		if s.Range, err = parseRange(init.Range); err != nil {
+			return dashSegment{}, err
+		}
+	}
+	return s, nil
+}
+
+// parseRange parses a byte range like "0-863"
+func parseRange(s string) (*Segment, error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid byte range %q", s)
+	}
+	start, err1 := strconv.ParseInt(strings.TrimSpace(s[:i]), 10, 64)
+	end, err2 := strconv.ParseInt(strings.TrimSpace(s[i+1:]), 10, 64)
+	if err1 != nil || err2 != nil || end < start {
+		return nil, fmt.Errorf("invalid byte range %q", s)
+	}
+	return &Segment{Start: start, End: end}, nil
+}
+
+// resolveBase resolves the first BaseURL of an element against base
+func resolveBase(base *url.URL, baseURLs []string) (*url.URL, error) {
+	if len(baseURLs) == 0 || strings.TrimSpace(baseURLs[0]) == "" {
+		return base, nil
+	}
+	r, err := url.Parse(strings.TrimSpace(baseURLs[0]))
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(r), nil
+}
+
+// resolveURL resolves ref against base, an empty ref is base itself
+func resolveURL(base *url.URL, ref string) (string, error) {
+	r, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(r).String(), nil
+}
+
+// isoDuration matches the durations of a manifest like PT1H2M3.5S
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration returns an ISO 8601 duration in seconds, an empty duration is 0
+func parseISODuration(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if m[i+1] != "" {
+			v, _ := strconv.ParseFloat(m[i+1], 64)
+			seconds += v * unit
+		}
+	}
+	return seconds, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// saveDASH downloads the segments of every representation and concatenates them into
+// one file per representation. The segments of all representations share one directory
+func (p *Porter) saveDASH(ctx context.Context, progress ProgressReporter) error {
+	paths, err := p.OutputPaths()
+	if err != nil {
+		return err
+	}
+	var size int64
+	done := true
+	for _, filePath := range paths {
+		n, exists, _ := util.FileSize(filePath)
+		size += n
+		done = done && exists
+	}
+	if done {
+		p.Stream.Size = size
+		progress.Start(size, size)
+		return nil
+	}
+	dir, err := util.FilePath(p.Filename, p.Stream.URL.Ext, p.Path, false, p.Rename)
+	if err != nil {
+		return err
+	}
+	dir += SegmentsSuffix
+	// the segments of another selection are dropped, their indexes may be the same
+	segments, ids := p.Stream.Manifest.segments()
+	if err := p.saveSegmentsTo(ctx, dir, segments, ids, progress); err != nil {
+		return err
+	}
+	job := &segmentsJob{dir: dir}
+	size = 0
+	first := 0
+	for i, r := range p.Stream.Manifest.Representations {
+		files := make([]string, len(r.Segments))
+		for j := range r.Segments {
+			files[j] = job.segmentPath(first + j)
+		}
+		first += len(r.Segments)
+		// files of an earlier run may hold another selection and are joined again,
+		// a checksum set on the porter can't describe several files
+		n, err := p.concat(paths[i], files, nil)
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+	p.Stream.Size = size
+	return os.RemoveAll(dir)
+}
+
+// dashFilePaths returns the final path of every representation
+func (p *Porter) dashFilePaths() ([]string, error) {
+	reps := p.Stream.Manifest.Representations
+	paths := make([]string, len(reps))
+	for i, r := range reps {
+		var err error
+		if paths[i], err = util.FilePath(r.Filename, "", p.Path, false, false); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,60 @@
+package porter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errRemoteChanged is returned when the server no longer serves the file being resumed
+var errRemoteChanged = errors.New("remote file changed")
+
+// DownloadError is returned when every attempt to download has failed,
+// Err is the cause of the last attempt
+type DownloadError struct {
+	Url      string
+	Attempts int
+	Err      error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("download %s failed after %d attempts: %v", e.Url, e.Attempts, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// ShortReadError is returned when fewer bytes than expected were received
+type ShortReadError struct {
+	Written int64
+	Size    int64
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("short read: got %d of %d bytes", e.Written, e.Size)
+}
+
+// DiskSpaceError is returned before a download starts when the disk can't hold the file
+type DiskSpaceError struct {
+	Path string
+	Need int64
+	Free int64
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space for %s: need %d bytes, %d free", e.Path, e.Need, e.Free)
+}
+
+// PieceError is returned when pieces of a file still don't match their
+// Metalink hashes after they were downloaded again
+type PieceError struct {
+	Algo   string
+	Pieces []int
+}
+
+func (e *PieceError) Error() string {
+	return fmt.Sprintf("%d pieces failed %s verification, the first is piece %d", len(e.Pieces), e.Algo, e.Pieces[0])
+}
+
+// ErrTooSlow is the cause of an attempt dropped because it stayed below Porter.MinSpeed
+var ErrTooSlow = errors.New("download speed stayed below the minimum")
@@ -0,0 +1,161 @@
+package porter
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/supeanut/ghttpload/pkg/util"
+)
+
+// NameSource tells where the filename of a stream came from
+type NameSource int
+
+const (
+	NameUnknown NameSource = iota
+	// NameFromUser is a filename given with SetFilename
+	NameFromUser
+	// NameFromContentDisposition is the filename of the Content-Disposition header
+	NameFromContentDisposition
+	// NameFromURL is the last path segment of the final URL after redirects
+	NameFromURL
+	// NameFromContentType is a default name with the extension of the Content-Type
+	NameFromContentType
+	// NameFromMetalink is the name of the file in a Metalink document
+	NameFromMetalink
+)
+
+func (s NameSource) String() string {
+	switch s {
+	case NameFromUser:
+		return "user"
+	case NameFromContentDisposition:
+		return "content-disposition"
+	case NameFromURL:
+		return "url"
+	case NameFromContentType:
+		return "content-type"
+	case NameFromMetalink:
+		return "metalink"
+	}
+	return "unknown"
+}
+
+// defaultName is used when neither the headers nor the URL give a name
+const defaultName = "download"
+
+// contentTypeExts are the usual extensions of types mime.ExtensionsByType
+// has several extensions for
+var contentTypeExts = map[string]string{
+	"application/dash+xml":          "mpd",
+	"application/gzip":              "gz",
+	"application/json":              "json",
+	"application/metalink4+xml":     "meta4",
+	"application/octet-stream":      "bin",
+	"application/pdf":               "pdf",
+	"application/vnd.apple.mpegurl": "m3u8",
+	"application/x-gzip":            "gz",
+	"application/x-mpegurl":         "m3u8",
+	"application/x-tar":             "tar",
+	"application/xml":               "xml",
+	"application/zip":               "zip",
+	"audio/mp4":                     "m4a",
+	"audio/mpeg":                    "mp3",
+	"image/jpeg":                    "jpg",
+	"image/png":                     "png",
+	"text/html":                     "html",
+	"text/plain":                    "txt",
+	"text/xml":                      "xml",
+	"video/mp2t":                    "ts",
+	"video/mp4":                     "mp4",
+	"video/webm":                    "webm",
+	"video/x-flv":                   "flv",
+}
+
+// detectName picks the filename of a HEAD response from Content-Disposition,
+// then the path of the final URL, then the Content-Type
+func detectName(resp *http.Response) (string, NameSource) {
+	if name := dispositionName(resp.Header.Get("Content-Disposition")); name != "" {
+		return name, NameFromContentDisposition
+	}
+	name, source := defaultName, NameFromContentType
+	if resp.Request != nil && resp.Request.URL != nil {
+		if base := util.SafeFileName(path.Base(resp.Request.URL.Path)); base != "" {
+			// the name comes from the URL even when its extension comes from the type
+			name, source = base, NameFromURL
+		}
+	}
+	if path.Ext(name) != "" {
+		return name, source
+	}
+	if ext := contentTypeExt(resp.Header.Get("Content-Type")); ext != "" {
+		name += "." + ext
+	}
+	return name, source
+}
+
+// dispositionName returns the sanitized filename of a Content-Disposition header,
+// a filename*= name in RFC 5987 encoding is preferred over filename=
+func dispositionName(v string) string {
+	if v == "" {
+		return ""
+	}
+	if _, params, err := mime.ParseMediaType(v); err == nil {
+		return util.SafeFileName(params["filename"])
+	}
+	// servers often send names with spaces or slashes unquoted, take them as they come
+	var name, extended string
+	for _, part := range strings.Split(v, ";") {
+		i := strings.Index(part, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(part[:i])), strings.TrimSpace(part[i+1:])
+		switch key {
+		case "filename":
+			name = strings.Trim(value, `"`)
+		case "filename*":
+			extended = decodeExtValue(strings.Trim(value, `"`))
+		}
+	}
+	if extended != "" {
+		return util.SafeFileName(extended)
+	}
+	return util.SafeFileName(name)
+}
+
+// decodeExtValue decodes an RFC 5987 value like UTF-8'en'%e2%82%ac%20rates,
+// only UTF-8 and ASCII are supported
+func decodeExtValue(v string) string {
+	parts := strings.SplitN(v, "'", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	switch strings.ToLower(parts[0]) {
+	case "utf-8", "us-ascii":
+	default:
+		return ""
+	}
+	s, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// contentTypeExt returns the extension of a Content-Type without the dot
+func contentTypeExt(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if ext, ok := contentTypeExts[t]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(t); len(exts) > 0 {
+		return strings.TrimPrefix(exts[0], ".")
+	}
+	return ""
+}
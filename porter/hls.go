@@ -0,0 +1,704 @@
+package porter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/supeanut/ghttpload/pkg/util"
+	"github.com/supeanut/ghttpload/request"
+)
+
+// SegmentsSuffix is appended to the output path for the directory holding
+// the media segments while they are downloaded
+const SegmentsSuffix = ".segments"
+
+// segmentsManifest is the file in the segments directory recording which
+// segment every segment file holds
+const segmentsManifest = "manifest.json"
+
+// segmentWorkers is how many media segments are fetched at once when Connections is less than 2
+const segmentWorkers = 4
+
+// maxPlaylistSize caps the size of a playlist read into memory
+const maxPlaylistSize = 16 << 20
+
+// Variant is one stream listed in an HLS master playlist
+type Variant struct {
+	Url string
+	// Bandwidth is the peak bits per second of the stream
+	Bandwidth int64
+	// Resolution is like "1280x720", empty for audio only streams
+	Resolution string
+	Codecs     string
+}
+
+// VariantSelect chooses the variant of a master playlist,
+// the highest bandwidth is chosen when nothing is set
+type VariantSelect struct {
+	// Resolution like "1280x720" picks the best variant of that resolution
+	Resolution string
+	// MaxBandwidth picks the best variant within this many bits per second,
+	// or the lowest one when none fits
+	MaxBandwidth int64
+}
+
+// pick returns the variant matching s
+func (s VariantSelect) pick(variants []Variant) Variant {
+	candidates := variants
+	if s.Resolution != "" {
+		var matching []Variant
+		for _, v := range variants {
+			if strings.EqualFold(v.Resolution, s.Resolution) {
+				matching = append(matching, v)
+			}
+		}
+		if len(matching) > 0 {
+			candidates = matching
+		}
+	}
+	sorted := append([]Variant{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Bandwidth > sorted[j].Bandwidth
+	})
+	if s.MaxBandwidth > 0 {
+		for _, v := range sorted {
+			if v.Bandwidth <= s.MaxBandwidth {
+				return v
+			}
+		}
+		return sorted[len(sorted)-1]
+	}
+	return sorted[0]
+}
+
+// SegmentKey decrypts a media segment
+type SegmentKey struct {
+	// Method is AES-128, other methods can't be decrypted
+	Method string
+	Url    string
+	IV     []byte
+}
+
+// MediaSegment is one file of a segmented stream
+type MediaSegment struct {
+	Url string
+	// Range is the part of Url holding the segment, nil for the whole file
+	Range *Segment
+	// Key is nil for segments which aren't encrypted
+	Key *SegmentKey
+}
+
+// Playlist is the media playlist of an HLS stream
+type Playlist struct {
+	Url string
+	// Variant is the stream picked from a master playlist, nil when Url was a media playlist
+	Variant *Variant
+	// Segments are in playback order, an EXT-X-MAP init section comes before the segments using it
+	Segments []MediaSegment
+	// Live is true when the playlist has no EXT-X-ENDLIST,
+	// only the segments listed at extract time are downloaded
+	Live bool
+}
+
+// SetVariant sets how the variant of an HLS master playlist is chosen
+func (p *Porter) SetVariant(resolution string, maxBandwidth int64) {
+	p.Variant = VariantSelect{Resolution: resolution, MaxBandwidth: maxBandwidth}
+}
+
+// isHLS reports whether a HEAD response is an HLS playlist
+func isHLS(resp *http.Response) bool {
+	t, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch strings.ToLower(t) {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl":
+		return true
+	}
+	return resp.Request != nil && resp.Request.URL != nil &&
+		strings.EqualFold(path.Ext(resp.Request.URL.Path), ".m3u8")
+}
+
+// extractHLS reads the playlist of the stream, following a master playlist to its variant
+func (p *Porter) extractHLS(ctx context.Context) error {
+	u := p.headURL()
+	var variant *Variant
+	for {
+		data, base, err := p.fetchPlaylist(ctx, u)
+		if err != nil {
+			return err
+		}
+		variants, playlist, err := parsePlaylist(data, base)
+		if err != nil {
+			return fmt.Errorf("%s: %v", u, err)
+		}
+		if playlist != nil {
+			playlist.Url = u
+			playlist.Variant = variant
+			p.Stream.Playlist = playlist
+			// the size and checksums of the HEAD response describe the playlist
+			p.Stream.URL.Size, p.Stream.Size = -1, -1
+			p.Stream.URL.Checksums = nil
+			return nil
+		}
+		if variant != nil {
+			return fmt.Errorf("%s: master playlist refers to another master playlist", u)
+		}
+		v := p.Variant.pick(variants)
+		variant = &v
+		u = v.Url
+	}
+}
+
+// fetchPlaylist returns the playlist at u and its final URL after redirects
+func (p *Porter) fetchPlaylist(ctx context.Context, u string) ([]byte, *url.URL, error) {
+	resp, err := request.GetFileContext(ctx, u, p.Headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	base := resp.Request.URL
+	return data, base, nil
+}
+
+// parsePlaylist parses an M3U8 playlist, either the variants of a master
+// playlist or the media playlist is returned. URIs are resolved against base
+func parsePlaylist(data []byte, base *url.URL) ([]Variant, *Playlist, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxPlaylistSize)
+	if !scanner.Scan() || strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff")) != "#EXTM3U" {
+		return nil, nil, fmt.Errorf("not an M3U8 playlist")
+	}
+	var (
+		variants  []Variant
+		variant   *Variant
+		playlist  = &Playlist{Live: true}
+		key       *SegmentKey
+		byteRange *Segment
+		// next offset of a byte range without one, per URI
+		nextOffset = map[string]int64{}
+		sequence   int64
+		initID     string
+		media      bool
+	)
+	resolve := func(ref string) (string, error) {
+		r, err := url.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(r).String(), nil
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			attrs := parseAttributes(line[len("#EXT-X-STREAM-INF:"):])
+			bandwidth, _ := strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			variant = &Variant{Bandwidth: bandwidth, Resolution: attrs["RESOLUTION"], Codecs: attrs["CODECS"]}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, _ = strconv.ParseInt(line[len("#EXT-X-MEDIA-SEQUENCE:"):], 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attrs := parseAttributes(line[len("#EXT-X-KEY:"):])
+			switch attrs["METHOD"] {
+			case "NONE":
+				key = nil
+			case "AES-128":
+				u, err := resolve(attrs["URI"])
+				if err != nil {
+					return nil, nil, err
+				}
+				key = &SegmentKey{Method: "AES-128", Url: u}
+				if iv := attrs["IV"]; iv != "" {
+					b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(b) != aes.BlockSize {
+						return nil, nil, fmt.Errorf("invalid IV %q", iv)
+					}
+					key.IV = b
+				}
+			default:
+				return nil, nil, fmt.Errorf("unsupported encryption %q", attrs["METHOD"])
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			attrs := parseAttributes(line[len("#EXT-X-MAP:"):])
+			u, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, nil, err
+			}
+			init := MediaSegment{Url: u}
+			if v, ok := attrs["BYTERANGE"]; ok {
+				if init.Range, err = parseByteRange(v, 0); err != nil {
+					return nil, nil, err
+				}
+			}
+			if id := fmt.Sprint(init.Url, init.Range); id != initID {
+				// the init section is written once before the segments it belongs to
+				initID = id
+				playlist.Segments = append(playlist.Segments, init)
+			}
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			r, err := parseByteRange(line[len("#EXT-X-BYTERANGE:"):], -1)
+			if err != nil {
+				return nil, nil, err
+			}
+			byteRange = r
+		case strings.HasPrefix(line, "#EXTINF:"):
+			media = true
+		case line == "#EXT-X-ENDLIST":
+			playlist.Live = false
+		case strings.HasPrefix(line, "#"):
+		default:
+			u, err := resolve(line)
+			if err != nil {
+				return nil, nil, err
+			}
+			if variant != nil {
+				variant.Url = u
+				variants = append(variants, *variant)
+				variant = nil
+				continue
+			}
+			media = true
+			s := MediaSegment{Url: u, Range: byteRange}
+			if s.Range != nil {
+				if s.Range.Start < 0 {
+					// the range follows the previous range of the same file
+					s.Range.Start = nextOffset[u]
+					s.Range.End += s.Range.Start
+				}
+				nextOffset[u] = s.Range.End + 1
+			}
+			if key != nil {
+				k := *key
+				if k.IV == nil {
+					// without IV the media sequence number is used
+					k.IV = make([]byte, aes.BlockSize)
+					binary.BigEndian.PutUint64(k.IV[8:], uint64(sequence))
+				}
+				s.Key = &k
+			}
+			playlist.Segments = append(playlist.Segments, s)
+			byteRange = nil
+			sequence++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(variants) > 0 {
+		return variants, nil, nil
+	}
+	if !media {
+		return nil, nil, fmt.Errorf("playlist has no segments")
+	}
+	return nil, playlist, nil
+}
+
+// parseAttributes parses an attribute list like BANDWIDTH=1280000,CODECS="avc1,mp4a"
+func parseAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+	for s != "" {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			break
+		}
+		name := strings.TrimSpace(s[:i])
+		s = s[i+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				end = len(s) - 1
+			}
+			value, s = s[1:end+1], s[end+1:]
+			if len(s) > 0 {
+				s = s[1:]
+			}
+			if i := strings.Index(s, ","); i >= 0 {
+				s = s[i+1:]
+			} else {
+				s = ""
+			}
+		} else if i := strings.Index(s, ","); i >= 0 {
+			value, s = s[:i], s[i+1:]
+		} else {
+			value, s = s, ""
+		}
+		attrs[name] = strings.TrimSpace(value)
+	}
+	return attrs
+}
+
+// parseByteRange parses "<length>[@<offset>]", a missing offset is
+// returned as a negative Start with End holding length-1
+func parseByteRange(s string, defaultOffset int64) (*Segment, error) {
+	s = strings.TrimSpace(s)
+	offset := defaultOffset
+	if i := strings.Index(s, "@"); i >= 0 {
+		o, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid byte range %q", s)
+		}
+		offset, s = o, s[:i]
+	}
+	length, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || length <= 0 {
+		return nil, fmt.Errorf("invalid byte range %q", s)
+	}
+	if offset < 0 {
+		return &Segment{Start: -1, End: length - 1}, nil
+	}
+	return &Segment{Start: offset, End: offset + length - 1}, nil
+}
+
+// segmentsJob is the state shared by the workers of a segmented download
+type segmentsJob struct {
+	dir      string
+	segments []MediaSegment
+	progress ProgressReporter
+	done     int32
+
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// saveSegmentsTo fetches every media segment into its own file in dir. Segment files
+// are named by their index, ids tell what every index holds and files of an earlier
+// run are kept only where its ids are the same
+func (p *Porter) saveSegmentsTo(ctx context.Context, dir string, segments []MediaSegment, ids []string, progress ProgressReporter) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	job := &segmentsJob{dir: dir, segments: segments, progress: progress, keys: map[string][]byte{}}
+	if err := job.prepare(ids); err != nil {
+		return err
+	}
+	progress.Start(-1, 0)
+	reportSegments(progress, 0, len(segments))
+
+	queue := make(chan int, len(segments))
+	for i := range segments {
+		queue <- i
+	}
+	close(queue)
+	workers := p.Connections
+	if workers < 2 {
+		workers = segmentWorkers
+	}
+	if workers > len(segments) {
+		workers = len(segments)
+	}
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil || errs[w] != nil {
+					return
+				}
+				if err := p.saveMediaSegment(ctx, job, i); err != nil {
+					errs[w] = err
+					return
+				}
+				reportSegments(progress, int(atomic.AddInt32(&job.done, 1)), len(segments))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentID tells the segment apart from segments of other playlists, variants or keys
+func segmentID(s MediaSegment) string {
+	id := s.Url
+	if s.Range != nil {
+		id += fmt.Sprintf(" bytes=%d-%d", s.Range.Start, s.Range.End)
+	}
+	if s.Key != nil {
+		id += fmt.Sprintf(" key=%s iv=%x", s.Key.Url, s.Key.IV)
+	}
+	return id
+}
+
+// segmentIDs returns the ids of segments
+func segmentIDs(segments []MediaSegment) []string {
+	ids := make([]string, len(segments))
+	for i, s := range segments {
+		ids[i] = segmentID(s)
+	}
+	return ids
+}
+
+// prepare removes the segment files whose index held another segment than ids
+// tell and records ids. Without a record every file is removed
+func (j *segmentsJob) prepare(ids []string) error {
+	manifestPath := filepath.Join(j.dir, segmentsManifest)
+	var saved []string
+	if b, err := ioutil.ReadFile(manifestPath); err == nil {
+		if json.Unmarshal(b, &saved) != nil {
+			saved = nil
+		}
+	}
+	infos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name() == segmentsManifest {
+			continue
+		}
+		i, err := strconv.Atoi(info.Name())
+		if err == nil && i < len(ids) && i < len(saved) && saved[i] == ids[i] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(j.dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifestPath+PartSuffix, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(manifestPath+PartSuffix, manifestPath)
+}
+
+// segmentPath returns the file of the segment with index i
+func (j *segmentsJob) segmentPath(i int) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%06d", i))
+}
+
+// saveMediaSegment fetches, decrypts and saves segment i unless it is already saved
+func (p *Porter) saveMediaSegment(ctx context.Context, job *segmentsJob, i int) error {
+	filePath := job.segmentPath(i)
+	if _, exists, _ := util.FileSize(filePath); exists {
+		return nil
+	}
+	s := job.segments[i]
+	var buf bytes.Buffer
+	err := p.attempt(ctx, job.progress, func(*source) (int64, error) {
+		buf.Reset()
+		return p.fetch(ctx, s.Url, s.Range, &buf)
+	})
+	if e, ok := err.(*DownloadError); ok {
+		e.Url = s.Url
+	}
+	if err != nil {
+		return err
+	}
+	// bytes of failed attempts are thrown away, only the last one counts
+	job.progress.Add(int64(buf.Len()))
+	data := buf.Bytes()
+	if s.Key != nil {
+		key, err := p.segmentKey(ctx, job, s.Key.Url)
+		if err != nil {
+			return err
+		}
+		if data, err = decryptSegment(data, key, s.Key.IV); err != nil {
+			return fmt.Errorf("%s: %v", s.Url, err)
+		}
+	}
+	if err := ioutil.WriteFile(filePath+PartSuffix, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filePath+PartSuffix, filePath)
+}
+
+// fetch copies the body of u, or of r within u, into w
+func (p *Porter) fetch(ctx context.Context, u string, r *Segment, w io.Writer) (int64, error) {
+	headers := map[string]string{}
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	if r != nil {
+		headers["Range"] = fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+	}
+	resp, err := request.GetFileContext(ctx, u, headers)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var body io.Reader = resp.Body
+	if r != nil {
+		if resp.StatusCode == http.StatusOK {
+			// the server sent the whole file, skip to the range
+			if _, err := io.CopyN(ioutil.Discard, body, r.Start); err != nil {
+				return 0, err
+			}
+		}
+		body = io.LimitReader(body, r.Size())
+	}
+	n, err := io.Copy(w, p.limit(ctx, body))
+	if err != nil {
+		return n, err
+	}
+	if resp.ContentLength >= 0 && r == nil && n < resp.ContentLength {
+		return n, &ShortReadError{Written: n, Size: resp.ContentLength}
+	}
+	if r != nil && n < r.Size() {
+		return n, &ShortReadError{Written: n, Size: r.Size()}
+	}
+	return n, nil
+}
+
+// segmentKey returns the AES-128 key at u, every key is fetched once
+func (p *Porter) segmentKey(ctx context.Context, job *segmentsJob, u string) ([]byte, error) {
+	job.mu.Lock()
+	key, ok := job.keys[u]
+	job.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	var buf bytes.Buffer
+	err := p.attempt(ctx, NopReporter{}, func(*source) (int64, error) {
+		buf.Reset()
+		return p.fetch(ctx, u, nil, &buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() != aes.BlockSize {
+		return nil, fmt.Errorf("%s: key has %d bytes, want %d", u, buf.Len(), aes.BlockSize)
+	}
+	key = buf.Bytes()
+	job.mu.Lock()
+	job.keys[u] = key
+	job.mu.Unlock()
+	return key, nil
+}
+
+// decryptSegment decrypts AES-128-CBC data and removes its PKCS#7 padding
+func decryptSegment(data, key, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment of %d bytes is not a multiple of the block size", len(data))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding, wrong key?")
+	}
+	for _, b := range data[len(data)-pad:] {
+		if int(b) != pad {
+			return nil, fmt.Errorf("invalid padding, wrong key?")
+		}
+	}
+	return data[:len(data)-pad], nil
+}
+
+// saveHLS downloads the segments of the playlist and concatenates them into one file
+func (p *Porter) saveHLS(ctx context.Context, progress ProgressReporter) error {
+	filePath, err := p.OutputPath()
+	if err != nil {
+		return err
+	}
+	// files only appear under their final path once they are complete
+	if size, exists, _ := util.FileSize(filePath); exists {
+		p.Stream.Size = size
+		progress.Start(size, size)
+		return nil
+	}
+	dir := filePath + SegmentsSuffix
+	segments := p.Stream.Playlist.Segments
+	if err := p.saveSegmentsTo(ctx, dir, segments, segmentIDs(segments), progress); err != nil {
+		return err
+	}
+	paths := make([]string, len(segments))
+	job := &segmentsJob{dir: dir}
+	for i := range segments {
+		paths[i] = job.segmentPath(i)
+	}
+	size, err := p.concat(filePath, paths, p.checksums())
+	if err != nil {
+		return err
+	}
+	p.Stream.Size = size
+	return os.RemoveAll(dir)
+}
+
+// concat writes the files in order to filePath through a .part file
+// which is checked against checksums, it returns the size written
+func (p *Porter) concat(filePath string, paths []string, checksums []Checksum) (int64, error) {
+	digest, err := newDigester(checksums)
+	if err != nil {
+		return 0, err
+	}
+	partPath := filePath + PartSuffix
+	out, err := os.Create(partPath)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	var w io.Writer = out
+	if digest != nil {
+		w = io.MultiWriter(out, digest)
+	}
+	var size int64
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	if digest != nil {
+		if err := digest.verify(); err != nil {
+			return 0, err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	return size, os.Rename(partPath, filePath)
+}
+
+// reportSegments tells a SegmentReporter how many segments are done
+func reportSegments(progress ProgressReporter, done, total int) {
+	if r, ok := progress.(SegmentReporter); ok {
+		r.Segments(done, total)
+	}
+}
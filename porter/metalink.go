@@ -0,0 +1,325 @@
+package porter
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/supeanut/ghttpload/pkg/util"
+)
+
+// metalink namespaces of RFC 5854 and of the older version 3
+const (
+	metalinkNS  = "urn:ietf:params:xml:ns:metalink"
+	metalink3NS = "http://www.metalinker.org/"
+)
+
+// lowestPriority is the priority of Metalink URLs which don't tell theirs
+const lowestPriority = 999999
+
+// maxPieceRounds is how often corrupt pieces are downloaded again before giving up
+const maxPieceRounds = 3
+
+// MetalinkFile is one file of a Metalink document
+type MetalinkFile struct {
+	// Name is the last element of the file name, "" when it isn't usable
+	Name string
+	// Size is -1 when the document doesn't tell
+	Size int64
+	// Checksums are the whole file hashes with a supported algorithm
+	Checksums []Checksum
+	// Pieces are the strongest supported piece hashes, nil when there are none
+	Pieces *Pieces
+	// URLs are the HTTP URLs of the file, ordered by priority
+	URLs []MetalinkURL
+}
+
+// MetalinkURL is a URL of a Metalink file
+type MetalinkURL struct {
+	Url string
+	// Priority is 1 for the most preferred URL, version 3 preferences are converted
+	Priority int
+	// Location is the ISO 3166-1 country code of the server, if known
+	Location string
+}
+
+// Pieces are the digests of the consecutive blocks a file is split into
+type Pieces struct {
+	Algo   string
+	Length int64
+	// Hashes are in hex encoding, one per block
+	Hashes []string
+}
+
+// piece returns the range of piece i in a file of size bytes
+func (ps *Pieces) piece(i int, size int64) Segment {
+	start := int64(i) * ps.Length
+	end := start + ps.Length - 1
+	if end >= size {
+		end = size - 1
+	}
+	return Segment{Start: start, End: end}
+}
+
+// check hashes the pieces of the first size bytes of r and returns the corrupt ones
+func (ps *Pieces) check(r io.ReaderAt, size int64) ([]int, error) {
+	if ps.Length <= 0 || int64(len(ps.Hashes)) != (size+ps.Length-1)/ps.Length {
+		return nil, fmt.Errorf("%d pieces of %d bytes don't match a size of %d bytes", len(ps.Hashes), ps.Length, size)
+	}
+	h, err := newHash(ps.Algo)
+	if err != nil {
+		return nil, err
+	}
+	var bad []int
+	for i, want := range ps.Hashes {
+		s := ps.piece(i, size)
+		h.Reset()
+		if _, err := io.Copy(h, io.NewSectionReader(r, s.Start, s.Size())); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != want {
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
+
+type metalinkDoc struct {
+	XMLName xml.Name
+	Files   []metalinkFile `xml:"file"`
+	// version 3 wraps the files
+	Files3 []metalinkFile `xml:"files>file"`
+}
+
+type metalinkFile struct {
+	Name   string           `xml:"name,attr"`
+	Size   int64            `xml:"size"`
+	Hashes []metalinkHash   `xml:"hash"`
+	Pieces []metalinkPieces `xml:"pieces"`
+	URLs   []metalinkURL    `xml:"url"`
+	// version 3 nests hashes and URLs
+	Hashes3 []metalinkHash   `xml:"verification>hash"`
+	Pieces3 []metalinkPieces `xml:"verification>pieces"`
+	URLs3   []metalinkURL    `xml:"resources>url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Piece int    `xml:"piece,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Type   string         `xml:"type,attr"`
+	Length int64          `xml:"length,attr"`
+	Hashes []metalinkHash `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Priority   int    `xml:"priority,attr"`
+	Preference int    `xml:"preference,attr"`
+	Location   string `xml:"location,attr"`
+	Type       string `xml:"type,attr"`
+	Value      string `xml:",chardata"`
+}
+
+// ParseMetalink reads the files of a Metalink document, version 4 of RFC 5854
+// or version 3. Files without an HTTP URL are an error
+func ParseMetalink(r io.Reader) ([]MetalinkFile, error) {
+	var doc metalinkDoc
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.XMLName.Local != "metalink" {
+		return nil, fmt.Errorf("not a metalink document: <%s>", doc.XMLName.Local)
+	}
+	v3 := doc.XMLName.Space == metalink3NS
+	if !v3 && doc.XMLName.Space != metalinkNS {
+		return nil, fmt.Errorf("unknown metalink namespace %q", doc.XMLName.Space)
+	}
+	docFiles := doc.Files
+	if v3 {
+		docFiles = doc.Files3
+	}
+	if len(docFiles) == 0 {
+		return nil, fmt.Errorf("metalink has no files")
+	}
+	var files []MetalinkFile
+	for _, df := range docFiles {
+		if v3 {
+			df.Hashes, df.Pieces, df.URLs = df.Hashes3, df.Pieces3, df.URLs3
+		}
+		f := MetalinkFile{Name: util.SafeFileName(df.Name), Size: df.Size, Pieces: strongestPieces(df.Pieces)}
+		if f.Size <= 0 {
+			f.Size = -1
+		}
+		for _, h := range df.Hashes {
+			if SupportedChecksum(h.Type) {
+				f.Checksums = append(f.Checksums, Checksum{Algo: normalizeAlgo(h.Type), Hex: strings.ToLower(strings.TrimSpace(h.Value))})
+			}
+		}
+		sort.SliceStable(f.Checksums, func(i, j int) bool {
+			return algoStrength(f.Checksums[i].Algo) > algoStrength(f.Checksums[j].Algo)
+		})
+		for _, du := range df.URLs {
+			u, ok := metalinkHTTPURL(du, v3)
+			if ok {
+				f.URLs = append(f.URLs, u)
+			}
+		}
+		if len(f.URLs) == 0 {
+			return nil, fmt.Errorf("metalink file %q has no http url", df.Name)
+		}
+		sort.SliceStable(f.URLs, func(i, j int) bool {
+			return f.URLs[i].Priority < f.URLs[j].Priority
+		})
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// ParseMetalinkFile reads the files of the Metalink document at path, - for stdin
+func ParseMetalinkFile(path string) ([]MetalinkFile, error) {
+	if path == "-" {
+		return ParseMetalink(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMetalink(f)
+}
+
+// metalinkHTTPURL converts a URL of the document, other schemes than HTTP are skipped
+func metalinkHTTPURL(du metalinkURL, v3 bool) (MetalinkURL, bool) {
+	raw := strings.TrimSpace(du.Value)
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return MetalinkURL{}, false
+	}
+	if t := strings.ToLower(du.Type); v3 && t != "" && t != "http" && t != "https" {
+		// torrents and other metadata are served over http too
+		return MetalinkURL{}, false
+	}
+	m := MetalinkURL{Url: raw, Priority: du.Priority, Location: strings.ToLower(strings.TrimSpace(du.Location))}
+	if v3 {
+		// preferences run from 100 for the most preferred URL down to 0
+		m.Priority = 101 - du.Preference
+	}
+	if m.Priority <= 0 || m.Priority > lowestPriority {
+		m.Priority = lowestPriority
+	}
+	return m, true
+}
+
+// strongestPieces returns the piece hashes of the strongest supported algorithm
+func strongestPieces(pieces []metalinkPieces) *Pieces {
+	var best *Pieces
+	for _, dp := range pieces {
+		if !SupportedChecksum(dp.Type) || dp.Length <= 0 || len(dp.Hashes) == 0 {
+			continue
+		}
+		if best != nil && algoStrength(dp.Type) <= algoStrength(best.Algo) {
+			continue
+		}
+		hashes := append([]metalinkHash{}, dp.Hashes...)
+		// version 3 numbers its piece hashes
+		sort.SliceStable(hashes, func(i, j int) bool {
+			return hashes[i].Piece < hashes[j].Piece
+		})
+		ps := &Pieces{Algo: normalizeAlgo(dp.Type), Length: dp.Length}
+		for _, h := range hashes {
+			ps.Hashes = append(ps.Hashes, strings.ToLower(strings.TrimSpace(h.Value)))
+		}
+		best = ps
+	}
+	return best
+}
+
+// algoStrength ranks the supported algorithms, the strongest is used
+func algoStrength(algo string) int {
+	switch normalizeAlgo(algo) {
+	case "sha512":
+		return 4
+	case "sha256":
+		return 3
+	case "sha1":
+		return 2
+	case "md5":
+		return 1
+	}
+	return 0
+}
+
+// SetMetalink downloads the file f describes. URLs in one of locations come first,
+// in the order of locations, then URLs by priority. The first URL becomes the
+// primary URL, the others mirrors. Size, the strongest checksum and the piece
+// hashes are verified, a corrupt piece is downloaded again on its own
+func (p *Porter) SetMetalink(f MetalinkFile, locations ...string) {
+	urls := append([]MetalinkURL{}, f.URLs...)
+	rank := func(u MetalinkURL) int {
+		for i, l := range locations {
+			if strings.EqualFold(strings.TrimSpace(l), u.Location) {
+				return i
+			}
+		}
+		return len(locations)
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		return rank(urls[i]) < rank(urls[j])
+	})
+	if len(urls) > 0 {
+		p.SetUrl(urls[0].Url)
+		for _, u := range urls[1:] {
+			p.AddMirror(u.Url)
+		}
+	}
+	if p.Filename == "" && f.Name != "" {
+		p.Filename = f.Name
+		p.Stream.NameSource = NameFromMetalink
+	}
+	if f.Size > 0 {
+		p.ExpectedSize = f.Size
+	}
+	if len(f.Checksums) > 0 {
+		p.Checksum = f.Checksums[0]
+	}
+	p.Pieces = f.Pieces
+}
+
+// verifyPieces checks the pieces of the complete file and downloads the corrupt
+// ones again. Pieces still corrupt are left missing in state, so the next run
+// fetches only them
+func (p *Porter) verifyPieces(ctx context.Context, file *os.File, state *ResumeState, digest *digester, progress ProgressReporter) error {
+	size := p.Stream.URL.Size
+	if size < 0 {
+		size = state.Written()
+	}
+	for round := 0; ; round++ {
+		bad, err := p.Pieces.check(file, size)
+		if err != nil || len(bad) == 0 {
+			return err
+		}
+		for _, i := range bad {
+			state.remove(p.Pieces.piece(i, size))
+		}
+		if digest != nil {
+			// finish hashes the file again
+			digest.Reset()
+		}
+		if round == maxPieceRounds || !p.Stream.URL.AcceptRanges {
+			return &PieceError{Algo: p.Pieces.Algo, Pieces: bad}
+		}
+		progress.Start(size, state.Written())
+		if err := p.saveSegments(ctx, file, state, progress); err != nil {
+			return err
+		}
+	}
+}
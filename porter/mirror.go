@@ -0,0 +1,293 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/supeanut/ghttpload/request"
+)
+
+// mirrorFailures is how many failures in a row take a mirror out of rotation
+const mirrorFailures = 3
+
+// slowRatio is how many times faster another mirror must be before a request is moved to it
+const slowRatio = 4
+
+// mirrorCheck is how often the speed of requests is compared between mirrors
+var mirrorCheck = 2 * time.Second
+
+var (
+	errMirrorSlow     = errors.New("mirror is too slow")
+	errMirrorMismatch = errors.New("mirror doesn't serve the same file")
+)
+
+// MirrorStat is the share of a download fetched from one URL
+type MirrorStat struct {
+	Url   string
+	Bytes int64
+	// Err tells why the mirror was dropped, nil while it is in use
+	Err error
+}
+
+// source is a URL the stream can be fetched from, the primary URL or a mirror
+type source struct {
+	url   URL
+	bytes int64
+
+	// guarded by mirrors.mu
+	active   int
+	failures int
+	// rate is the last measured speed in bytes per second
+	rate float64
+	// down sources are used only when no other source is left
+	down bool
+	// disabled sources don't serve the same file and are never used
+	disabled bool
+	err      error
+}
+
+// mirrors holds the sources of a download, it is safe for concurrent use
+type mirrors struct {
+	mu      sync.Mutex
+	sources []*source
+}
+
+// AddMirror adds a URL serving the same file as the primary URL,
+// it is checked for a matching size and ETag by Extract
+func (p *Porter) AddMirror(url string) {
+	p.Mirrors = append(p.Mirrors, strings.TrimSpace(url))
+}
+
+// MirrorStats returns how many bytes came from the primary URL and from every mirror
+func (p *Porter) MirrorStats() []MirrorStat {
+	m := &p.mirrors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]MirrorStat, len(m.sources))
+	for i, s := range m.sources {
+		stats[i] = MirrorStat{Url: s.url.Url, Bytes: atomic.LoadInt64(&s.bytes)}
+		if s.down || s.disabled {
+			stats[i].Err = s.err
+		}
+	}
+	return stats
+}
+
+// checkMirrors compares every mirror with the primary URL and rebuilds the sources,
+// bytes counted so far are kept
+func (p *Porter) checkMirrors(ctx context.Context) {
+	urls := make([]URL, len(p.Mirrors))
+	errs := make([]error, len(p.Mirrors))
+	var wg sync.WaitGroup
+	for i, u := range p.Mirrors {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			urls[i], errs[i] = p.checkMirror(ctx, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	m := &p.mirrors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := map[string]int64{}
+	for _, s := range m.sources {
+		old[s.url.Url] = atomic.LoadInt64(&s.bytes)
+	}
+	primary := &source{url: p.Stream.URL, bytes: old[p.Stream.URL.Url]}
+	if p.headErr != nil {
+		// the primary URL failed in Extract, the mirrors go first
+		primary.down, primary.err = true, p.headErr
+	}
+	m.sources = []*source{primary}
+	for i, u := range urls {
+		s := &source{url: u, bytes: old[p.Mirrors[i]]}
+		s.url.Url = p.Mirrors[i]
+		if errs[i] != nil {
+			s.disabled, s.err = true, errs[i]
+		}
+		m.sources = append(m.sources, s)
+	}
+}
+
+// checkMirror reads the remote file of a mirror and checks it against the primary URL
+func (p *Porter) checkMirror(ctx context.Context, url string) (URL, error) {
+	u := URL{Url: url}
+	h, err := request.GetHeaderContext(ctx, url, p.Headers)
+	if err != nil {
+		return u, err
+	}
+	if u.Size, err = request.ContentLength(h); err != nil {
+		return u, err
+	}
+	u.AcceptRanges = request.AcceptRanges(h)
+	u.ETag = h.Get("ETag")
+	u.LastModified = h.Get("Last-Modified")
+	primary := p.Stream.URL
+	switch {
+	case u.Size != primary.Size:
+		return u, fmt.Errorf("%v: size %d, want %d", errMirrorMismatch, u.Size, primary.Size)
+	// servers give the same file different ETags, piece hashes check the content instead
+	case u.ETag != "" && primary.ETag != "" && u.ETag != primary.ETag && p.Pieces == nil:
+		return u, fmt.Errorf("%v: ETag %s, want %s", errMirrorMismatch, u.ETag, primary.ETag)
+	case primary.AcceptRanges && !u.AcceptRanges:
+		return u, fmt.Errorf("%v: no range support", errMirrorMismatch)
+	}
+	return u, nil
+}
+
+// pickSource returns the source for the next request, the one with the fewest
+// requests running among those in use. After a failure on prev another source is
+// preferred, down sources are only picked when every source is down
+func (p *Porter) pickSource(prev *source) *source {
+	m := &p.mirrors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sources) == 0 {
+		m.sources = []*source{{url: p.Stream.URL}}
+	}
+	var best *source
+	better := func(s *source) bool {
+		if best == nil {
+			return true
+		}
+		if (s == prev) != (best == prev) {
+			return best == prev
+		}
+		return s.active < best.active
+	}
+	for _, s := range m.sources {
+		if !s.down && !s.disabled && better(s) {
+			best = s
+		}
+	}
+	if best == nil {
+		for _, s := range m.sources {
+			if !s.disabled && (best == nil || s.failures < best.failures) {
+				best = s
+			}
+		}
+	}
+	if best == nil {
+		best = m.sources[0]
+	}
+	best.active++
+	return best
+}
+
+// release ends a request on s, err is nil when it succeeded. It reports whether
+// another source in use can take over, which costs no retry
+func (p *Porter) release(s *source, written int64, err error) bool {
+	m := &p.mirrors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.active--
+	if written > 0 {
+		s.failures = 0
+	}
+	if err == nil {
+		return false
+	}
+	s.failures++
+	switch {
+	case err == errMirrorSlow:
+		s.down, s.err = true, err
+	case err == errMirrorMismatch:
+		s.disabled, s.err = true, err
+	case !p.retryable(err), s.failures >= mirrorFailures:
+		s.down, s.err = true, err
+	}
+	for _, o := range m.sources {
+		if o != s && !o.down && !o.disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// multiSource reports whether more than one source is in use
+func (p *Porter) multiSource() bool {
+	m := &p.mirrors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, s := range m.sources {
+		if !s.down && !s.disabled {
+			n++
+		}
+	}
+	return n > 1
+}
+
+// watchSpeed measures the speed of a request on s from the bytes counted in read,
+// it calls cancel and marks s slow when another source is much faster.
+// stop records the average speed of a request which wasn't canceled
+func (p *Porter) watchSpeed(s *source, read *int64, cancel context.CancelFunc) (stop func(), slow func() bool) {
+	done := make(chan struct{})
+	start, first := time.Now(), atomic.LoadInt64(read)
+	interval := mirrorCheck
+	var isSlow int32
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := first
+		for ticks := 0; ; ticks++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			n := atomic.LoadInt64(read)
+			rate := float64(n-last) / interval.Seconds()
+			last = n
+			// the first interval includes connecting and is not compared
+			if ticks == 0 {
+				continue
+			}
+			if p.sample(s, rate) {
+				atomic.StoreInt32(&isSlow, 1)
+				cancel()
+				return
+			}
+		}
+	}()
+	stop = func() {
+		close(done)
+		if atomic.LoadInt32(&isSlow) == 0 {
+			p.sample(s, float64(atomic.LoadInt64(read)-first)/time.Since(start).Seconds())
+		}
+	}
+	return stop, func() bool { return atomic.LoadInt32(&isSlow) == 1 }
+}
+
+// sample records the rate of s and reports whether s is too slow compared to another source
+func (p *Porter) sample(s *source, rate float64) bool {
+	m := &p.mirrors
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.rate = rate
+	for _, o := range m.sources {
+		if o != s && !o.down && !o.disabled && o.rate > rate*slowRatio {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceWriter counts the bytes fetched from a source and by one request
+type sourceWriter struct {
+	source *source
+	read   *int64
+}
+
+func (w sourceWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&w.source.bytes, int64(len(b)))
+	atomic.AddInt64(w.read, int64(len(b)))
+	return len(b), nil
+}
@@ -5,13 +5,20 @@ import (
 	"strings"
 	"github.com/supeanut/ghttpload/pkg/util"
 	"github.com/supeanut/ghttpload/request"
-	"github.com/cheggaaa/pb"
 	"time"
 	"fmt"
 	"os"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"context"
 )
 
+// PartSuffix is appended to the output path while the download is in progress
+const PartSuffix = ".part"
+
 type Porter struct {
 	// path for download
 	Path string
@@ -27,12 +34,63 @@ type Porter struct {
 	Request httplib.HttpRequest
 	// if set to -1 means will retry forever
 	Retries int
+	// Retry decides which failed requests are retried and the backoff between them,
+	// the retries are counted by Retries
+	Retry httplib.RetryPolicy
+	// number of parallel connections used for one stream
+	Connections int
+	// MinSpeed in bytes per second is the slowest a request may be for MinSpeedWindow
+	// before it is reissued, 0 means no minimum
+	MinSpeed       int64
+	MinSpeedWindow time.Duration
+	// MinSegmentSize is the smallest range split off for an idle connection,
+	// DefaultMinSegmentSize when not set
+	MinSegmentSize int64
+	// Progress receives the download progress, a terminal bar is used when nil
+	Progress ProgressReporter
+	// Checksum the downloaded file is verified against when Algo is set
+	Checksum Checksum
+	// Sync keeps the validators of completed files, unchanged files aren't downloaded again
+	Sync bool
+	// ExpectedSize is the size the remote file must have, 0 when unknown
+	ExpectedSize int64
+	// Pieces are checked once the file is complete, corrupt pieces are downloaded again
+	Pieces *Pieces
+	// RateLimiter throttles this porter on top of the global limit
+	RateLimiter *RateLimiter
+	// Headers are sent with every request
+	Headers map[string]string
+	// Mirrors serve the same file as Stream.URL, segments are spread across them
+	Mirrors []string
+	// Variant chooses the stream of an HLS master playlist
+	Variant VariantSelect
+	// Video and Audio choose the representations of a DASH manifest
+	Video RepresentationSelect
+	Audio RepresentationSelect
+
+	control control
+	mirrors mirrors
+	// head is the mirror the remote file is read from while the primary URL
+	// is unavailable, headErr tells why
+	head    string
+	headErr error
+	// splits and takeOvers count the rescheduled ranges of segmented downloads
+	splits    int32
+	takeOvers int32
 }
 
 type Stream struct {
 	URL URL
-	// total size of stream
+	// total size of stream, -1 when the server doesn't tell
 	Size int64
+	// NameSource tells where Porter.Filename came from
+	NameSource NameSource
+	// Playlist is set for HLS streams, their segments are joined into one .ts file
+	Playlist *Playlist
+	// Manifest is set for DASH streams, every representation is saved to its own file
+	Manifest *Manifest
+	// Unchanged is set in sync mode when the file on disk is still current
+	Unchanged bool
 	// name used in storedStream
 	name string
 }
@@ -40,18 +98,89 @@ type Stream struct {
 // URL for single URL information
 type URL struct {
 	Url string
+	// Size is -1 when the server sends no Content-Length
 	Size int64
 	Ext  string
+	// AcceptRanges is true when the server supports byte ranges
+	AcceptRanges bool
+	// validators of the remote file, used to detect changes on resume
+	ETag         string
+	LastModified string
+	// checksums announced by the server in Digest or Content-MD5
+	Checksums []Checksum
+}
+
+// ifRange returns the validator sent in If-Range, weak ETags can't be used there
+func (u URL) ifRange() string {
+	if u.ETag != "" && !strings.HasPrefix(u.ETag, "W/") {
+		return u.ETag
+	}
+	return u.LastModified
+}
+
+// resumable reports whether bytes written earlier may be kept, a file of
+// unknown size needs a validator to tell that it hasn't changed
+func (u URL) resumable() bool {
+	return u.Size >= 0 || u.ifRange() != ""
 }
 
 func NewPorter() *Porter {
-	return &Porter{}
+	return &Porter{RateLimiter: NewRateLimiter(0), Retry: httplib.DefaultRetryPolicy()}
 }
 
 func (p *Porter) SetRetries(n int) {
 	p.Retries = n
 }
 
+// SetRetryPolicy replaces the retries, backoff and retryable statuses of the porter
+func (p *Porter) SetRetryPolicy(policy httplib.RetryPolicy) {
+	p.Retry = policy
+	p.Retries = policy.Retries
+}
+
+// SetConnections sets how many connections are used to download one stream,
+// values less than 2 mean a single stream
+func (p *Porter) SetConnections(n int) {
+	p.Connections = n
+}
+
+// SetProgress sets the reporter receiving the download progress
+func (p *Porter) SetProgress(reporter ProgressReporter) {
+	p.Progress = reporter
+}
+
+// SetHeader adds a header sent with every request
+func (p *Porter) SetHeader(key, value string) {
+	if p.Headers == nil {
+		p.Headers = map[string]string{}
+	}
+	p.Headers[key] = value
+}
+
+// SetRateLimit limits the download speed in bytes per second, 0 means unlimited.
+// It may be changed while the download is running
+func (p *Porter) SetRateLimit(bytesPerSec int64) {
+	if p.RateLimiter == nil {
+		p.RateLimiter = NewRateLimiter(bytesPerSec)
+		return
+	}
+	p.RateLimiter.SetRate(bytesPerSec)
+}
+
+// SetChecksum sets the expected md5, sha1, sha256 or sha512 digest in hex
+func (p *Porter) SetChecksum(algo, hex string) {
+	p.Checksum = Checksum{Algo: algo, Hex: hex}
+}
+
+// checksums returns every checksum the download has to match
+func (p *Porter) checksums() []Checksum {
+	checksums := p.Stream.URL.Checksums
+	if p.Checksum.Algo != "" {
+		checksums = append([]Checksum{p.Checksum}, checksums...)
+	}
+	return checksums
+}
+
 func (p *Porter) SetPath(path string) {
 	p.Path = strings.TrimSpace(path)
 }
@@ -66,49 +195,214 @@ func (p *Porter) SetUrl(url string) {
 }
 
 func (p *Porter) extract() error {
-	filename, ext, err := util.GetNameAndExt(p.Stream.URL.Url)
-	if err != nil {
+	if _, err := url.ParseRequestURI(p.Stream.URL.Url); err != nil {
 		return err
 	}
-	size, err := request.GetContentSize(p.Stream.URL.Url)
+	var record *syncRecord
+	if p.Sync {
+		// known filenames are checked with a conditional request
+		record = p.loadSync()
+	}
+	p.head, p.headErr = "", nil
+	resp, err := p.refreshIf(context.Background(), record)
+	for i := 0; err != nil && i < len(p.Mirrors); i++ {
+		// the primary URL is unavailable, a mirror tells about the remote file
+		// and serves the requests. Stream.URL stays the URL of resume state and sync records
+		if p.headErr == nil {
+			p.headErr = err
+		}
+		p.head = p.Mirrors[i]
+		resp, err = p.refreshIf(context.Background(), record)
+	}
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode == http.StatusNotModified {
+		record.unchanged(p)
+		p.Stream.NameSource = NameFromUser
+		p.Stream.URL.Ext = strings.TrimPrefix(filepath.Ext(p.Filename), ".")
+		return nil
+	}
 	if p.Filename == "" {
-		p.Filename = filename
+		p.Filename, p.Stream.NameSource = detectName(resp)
+	} else if p.Stream.NameSource != NameFromMetalink {
+		p.Stream.NameSource = NameFromUser
+	}
+	if isHLS(resp) {
+		if err := p.extractHLS(context.Background()); err != nil {
+			return err
+		}
+		if p.Stream.NameSource != NameFromUser {
+			// the segments are joined into a transport stream
+			p.Filename = strings.TrimSuffix(p.Filename, filepath.Ext(p.Filename)) + ".ts"
+		}
+	} else if isDASH(resp) {
+		if err := p.extractDASH(context.Background()); err != nil {
+			return err
+		}
+		p.Filename = strings.TrimSuffix(p.Filename, filepath.Ext(p.Filename))
+		p.Stream.Manifest.nameRepresentations(p.Filename)
+	}
+	p.Stream.URL.Ext = strings.TrimPrefix(filepath.Ext(p.Filename), ".")
+	if p.Sync && p.Stream.Playlist == nil && p.Stream.Manifest == nil {
+		if record == nil {
+			// the filename came with the response
+			record = p.loadSync()
+		}
+		if record != nil && record.matches(p.Stream.URL) {
+			p.Stream.Unchanged = true
+		}
 	}
-	p.Stream.URL.Ext = ext
-	p.Stream.URL.Size = size
 	return nil
 }
 
+// headURL returns the URL the remote file is read from
+func (p *Porter) headURL() string {
+	if p.head != "" {
+		return p.head
+	}
+	return p.Stream.URL.Url
+}
+
+// refresh reads size, range support and validators of the remote file
+// and checks the mirrors against it, the HEAD response is returned
+func (p *Porter) refresh(ctx context.Context) (*http.Response, error) {
+	return p.refreshIf(ctx, nil)
+}
+
+// refreshIf is refresh with the conditions of a sync record. A 304 response
+// is returned as is, the stream is left alone
+func (p *Porter) refreshIf(ctx context.Context, record *syncRecord) (*http.Response, error) {
+	headers := p.Headers
+	if record != nil {
+		headers = record.conditions(p.Headers)
+	}
+	resp, err := request.HeadContext(ctx, p.headURL(), headers)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	h := resp.Header
+	size, err := request.ContentLength(h)
+	if err != nil {
+		return nil, err
+	}
+	if p.ExpectedSize > 0 {
+		switch {
+		case size < 0:
+			size = p.ExpectedSize
+		case size != p.ExpectedSize:
+			return nil, fmt.Errorf("%s: size %d, want %d", p.Stream.URL.Url, size, p.ExpectedSize)
+		}
+	}
+	p.Stream.URL.Size = size
+	p.Stream.Size = size
+	p.Stream.URL.AcceptRanges = request.AcceptRanges(h)
+	p.Stream.URL.ETag = h.Get("ETag")
+	p.Stream.URL.LastModified = h.Get("Last-Modified")
+	p.Stream.URL.Checksums = headerChecksums(h)
+	p.checkMirrors(ctx)
+	return resp, nil
+}
+
 func (p *Porter) Extract() error {
 	err := p.extract()
 	if err != nil {
+		p.Err = err
 		return err
 	}
 	return nil
 }
 
 func (p *Porter) Download() error{
+	return p.DownloadContext(context.Background())
+}
+
+// DownloadContext is like Download but stops when ctx is done, the partial
+// file is kept so a later call resumes it, and ctx.Err() is returned
+func (p *Porter) DownloadContext(ctx context.Context) error {
 
 	// check filename
 	p.Filename = util.FileName(p.Filename)
 
-	bar := progressBar(p.Stream.URL.Size)
-	bar.Start()
-	err := p.save(bar)
+	progress := p.Progress
+	if progress == nil {
+		progress = NewBarReporter()
+	}
+	return p.download(ctx, progress, p.save)
+}
+
+// download runs save until the download completes or fails and reports the outcome
+func (p *Porter) download(ctx context.Context, progress ProgressReporter, save func(context.Context, ProgressReporter) error) error {
+	err := p.run(ctx, progress, save)
+	p.stop(err)
+	p.Err = err
 	if err != nil {
+		progress.Error(err)
 		return err
 	}
-	bar.Finish()
+	progress.Complete()
 	return nil
 }
 
+// run saves the stream and starts over from the saved state after each pause
+func (p *Porter) run(ctx context.Context, progress ProgressReporter, save func(context.Context, ProgressReporter) error) error {
+	for {
+		err := save(p.start(ctx), progress)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		paused, waitErr := p.wait(ctx)
+		if !paused {
+			return err
+		}
+		if waitErr != nil {
+			return waitErr
+		}
+	}
+}
+
 
-func (p *Porter) writeFile(file *os.File, headers map[string]string, bar *pb.ProgressBar) (int64, error) {
-	resp, err := request.GetFile(p.Stream.URL.Url, headers)
+// writeFile requests the range in headers from src and writes the body into file
+func (p *Porter) writeFile(ctx context.Context, src *source, file *offsetWriter, headers map[string]string, progress ProgressReporter) (int64, error) {
+	primary := src.url.Url == p.headURL()
+	var slow func() bool
+	if p.multiSource() {
+		// move the request to another mirror when this one is much slower
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		var stop func()
+		stop, slow = p.watchSpeed(src, &file.read, cancel)
+		defer stop()
+	}
+	var tooSlow func() bool
+	if p.MinSpeed > 0 {
+		// drop the request when it stays below the minimum speed
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		var stop func()
+		stop, tooSlow = p.watchMinSpeed(&file.read, cancel)
+		defer stop()
+	}
+	resp, err := request.GetFileContext(ctx, src.url.Url, headers)
 	if err != nil {
+		if tooSlow != nil && tooSlow() {
+			return 0, ErrTooSlow
+		}
+		// the requested range is beyond the end, the remote file has shrunk
+		if e, ok := err.(*request.StatusError); ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			if !primary {
+				return 0, errMirrorMismatch
+			}
+			return 0, errRemoteChanged
+		}
+		if slow != nil && slow() {
+			return 0, errMirrorSlow
+		}
 		return 0, err
 	}
 	if resp == nil {
@@ -118,36 +412,209 @@ func (p *Porter) writeFile(file *os.File, headers map[string]string, bar *pb.Pro
 		return 0, nil
 	}
 	defer resp.Body.Close()
-	writer := io.MultiWriter(file, bar)
+	var body io.Reader = resp.Body
+	if resp.StatusCode == http.StatusOK && headers["Range"] != "" {
+		// the server ignored Range or If-Range found the remote file changed,
+		// either way the body is the whole file and a segment can't use it
+		if !primary {
+			return 0, errMirrorMismatch
+		}
+		if _, end := file.bounds(); end >= 0 {
+			return 0, errRemoteChanged
+		}
+		p.Stream.URL.Size = resp.ContentLength
+		p.Stream.Size = resp.ContentLength
+		p.Stream.URL.ETag = resp.Header.Get("ETag")
+		p.Stream.URL.LastModified = resp.Header.Get("Last-Modified")
+		p.Stream.URL.Checksums = headerChecksums(resp.Header)
+		p.mirrors.mu.Lock()
+		u := p.Stream.URL
+		u.Url = src.url.Url
+		src.url = u
+		p.mirrors.mu.Unlock()
+		if !rewindable(file.file) && file.offset > 0 && headers["If-Range"] == "" {
+			// without validators the server ignored Range, the writer can't be
+			// rewound so the bytes it already holds are skipped
+			if _, err := io.CopyN(ioutil.Discard, body, file.offset); err != nil {
+				return 0, err
+			}
+		} else {
+			if err := p.restart(file.file, file.state, progress); err != nil {
+				return 0, err
+			}
+			file.offset = 0
+			if file.digest != nil {
+				file.digest.Reset()
+			}
+		}
+	}
+	if _, end := file.bounds(); end >= 0 {
+		// never write past the end of the segment, which moves when it is split
+		body = file.limit(body)
+	}
+	body = p.limit(ctx, body)
+	writers := []io.Writer{file, progressWriter{progress}, sourceWriter{src, &file.read}}
+	if file.digest != nil {
+		writers = append(writers, file.digest)
+	}
+	writer := io.MultiWriter(writers...)
 	// Note that io.Copy reads 32kb(maximum) from input and writes them to output
 	// So don't worry about memory.
-	written, copyErr := io.Copy(writer, resp.Body)
+	written, copyErr := io.Copy(writer, body)
+	if copyErr != nil && slow != nil && slow() {
+		return written, errMirrorSlow
+	}
+	if copyErr != nil && tooSlow != nil && tooSlow() {
+		return written, ErrTooSlow
+	}
 	if copyErr != nil {
 		return written, fmt.Errorf("file copy error: %s", copyErr)
 	}
 	return written, nil
 }
 
+// restart truncates file and forgets its progress so the download begins anew
+func (p *Porter) restart(file output, state *ResumeState, progress ProgressReporter) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	state.reset(p.Stream.URL)
+	progress.Start(p.Stream.URL.Size, 0)
+	return nil
+}
+
+// freeSpace is replaced in tests
+var freeSpace = util.FreeSpace
+
+// checkSpace fails when the disk can't hold the part of the stream
+// which isn't allocated at partPath yet
+func (p *Porter) checkSpace(partPath string) error {
+	partSize, _, err := util.FileSize(partPath)
+	if err != nil {
+		return err
+	}
+	need := p.Stream.URL.Size - partSize
+	if need <= 0 {
+		return nil
+	}
+	free, err := freeSpace(filepath.Dir(partPath))
+	if err != nil || free < 0 {
+		// the download fails on its own if the disk fills up
+		return nil
+	}
+	if free < need {
+		return &DiskSpaceError{Path: partPath, Need: need, Free: free}
+	}
+	return nil
+}
+
+// allocate grows file to the size of the stream up front, so the disk holds it
+// in one piece and segments are written at their offsets
+func (p *Porter) allocate(file *os.File) error {
+	if p.Stream.URL.Size <= 0 {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= p.Stream.URL.Size {
+		return nil
+	}
+	return preallocate(file, p.Stream.URL.Size)
+}
+
+// OutputPath returns the final path of the download, the file of the first
+// representation for a DASH stream
+func (p *Porter) OutputPath() (string, error) {
+	if p.Stream.Manifest != nil {
+		paths, err := p.dashFilePaths()
+		if err != nil {
+			return "", err
+		}
+		return paths[0], nil
+	}
+	return util.FilePath(p.Filename, p.Stream.URL.Ext, p.Path,false, p.Rename)
+}
+
+// OutputPaths returns the final paths of the download, one per representation for a DASH stream
+func (p *Porter) OutputPaths() ([]string, error) {
+	if p.Stream.Manifest != nil {
+		return p.dashFilePaths()
+	}
+	filePath, err := p.OutputPath()
+	if err != nil {
+		return nil, err
+	}
+	return []string{filePath}, nil
+}
+
+// GetFileSize returns the size of the downloaded file, or the bytes saved
+// so far while the download is in progress. The files of a DASH stream are added up
 func (p *Porter) GetFileSize() (int64, error) {
 	// check path
-	filePath, err := util.FilePath(p.Filename, p.Stream.URL.Ext, p.Path,false, p.Rename)
+	paths, err := p.OutputPaths()
 	if err != nil {
 		return 0, err
 	}
-	// check file
-	fileSize, exists, err := util.FileSize(filePath)
+	var size int64
+	for _, filePath := range paths {
+		// check file
+		fileSize, exists, err := util.FileSize(filePath)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			// the .part file is preallocated, its state tells how much of it is written
+			if state, _ := loadResumeState(filePath + StateSuffix); state != nil {
+				fileSize = state.Written()
+			} else if fileSize, _, err = util.FileSize(filePath + PartSuffix); err != nil {
+				return 0, err
+			} else if fileSize >= p.Stream.URL.Size {
+				// without state only a shorter prefix is resumed, see save
+				fileSize = 0
+			}
+		}
+		size += fileSize
+	}
+	return size, nil
+}
+
+// leftover reports whether the file at filePath was written after the remote file
+// last changed, only such a file is resumed and If-Range guards its ranges
+func (p *Porter) leftover(filePath string) bool {
+	u := p.Stream.URL
+	modified, err := http.ParseTime(u.LastModified)
+	if err != nil || !u.AcceptRanges {
+		return false
+	}
+	info, err := os.Stat(filePath)
+	return err == nil && !info.ModTime().Before(modified)
+}
+
+// Completed reports whether the download has been moved to its final path
+func (p *Porter) Completed() (bool, error) {
+	paths, err := p.OutputPaths()
 	if err != nil {
-		return 0, err
+		return false, err
 	}
-	if !exists {
-		return 0, nil
+	for _, filePath := range paths {
+		if _, exists, err := util.FileSize(filePath); !exists || err != nil {
+			return false, err
+		}
 	}
-	return fileSize, nil
+	return true, nil
 }
 
-func (p *Porter) save(bar *pb.ProgressBar) (err error) {
+func (p *Porter) save(ctx context.Context, progress ProgressReporter) (err error) {
+	if p.Stream.Playlist != nil {
+		return p.saveHLS(ctx, progress)
+	}
+	if p.Stream.Manifest != nil {
+		return p.saveDASH(ctx, progress)
+	}
 	// check path
-	filePath, err := util.FilePath(p.Filename, p.Stream.URL.Ext, p.Path,false, p.Rename)
+	filePath, err := p.OutputPath()
 	if err != nil {
 		return err
 	}
@@ -157,64 +624,237 @@ func (p *Porter) save(bar *pb.ProgressBar) (err error) {
 		return err
 	}
 
-	if bar == nil {
-		bar := progressBar(p.Stream.URL.Size)
-		bar.Start()
-	}
-
-	if exists && fileSize == p.Stream.URL.Size {
-		bar.Add64(fileSize)
+	// files only appear under their final path once they are complete,
+	// in sync mode they are kept only when the server says they are unchanged
+	if exists && (p.Stream.Unchanged || !p.Sync && (fileSize == p.Stream.URL.Size || p.Stream.URL.Size < 0)) {
+		progress.Start(p.Stream.URL.Size, fileSize)
 		return nil
 	}
 
-	tempFilePath := filePath
-	tempFileSize, _, err := util.FileSize(tempFilePath)
+	partPath := filePath + PartSuffix
+	partSize, partExists, err := util.FileSize(partPath)
 	if err != nil {
 		return err
 	}
-
-	headers := map[string]string{}
-	var (
-		file    *os.File
-		fileError error
-	)
-	if tempFileSize > 0 {
-		// range start from 0, 0-1023 means the first 1024 bytes of the file
-		headers["Range"] = fmt.Sprintf("bytes=%d-", tempFileSize)
-		file, fileError = os.OpenFile(tempFilePath, os.O_APPEND|os.O_WRONLY, 0644)
-		bar.Add64(tempFileSize)
-	} else {
-		file, fileError = os.Create(tempFilePath)
+	statePath := filePath + StateSuffix
+	_, stateExists, err := util.FileSize(statePath)
+	if err != nil {
+		return err
 	}
-	if fileError != nil {
-		return fileError
+	if exists && !partExists && !stateExists && !p.Sync && fileSize < p.Stream.URL.Size && p.leftover(filePath) {
+		// a partial file written to the final path by an older version,
+		// other files stay in place until the new download replaces them
+		if err := os.Rename(filePath, partPath); err != nil {
+			return err
+		}
+		partSize, partExists = fileSize, true
 	}
-	// begin download
-	temp := tempFileSize
-	for i := 0; p.Retries == -1 || i <= p.Retries; i++ {
-		written, err := p.writeFile(file, headers, bar)
-		if err == nil {
-			break
+
+	state, stateErr := loadResumeState(statePath)
+	switch {
+	case state != nil && state.Match(p.Stream.URL) && (state.extent() == 0 || partExists && partSize >= state.extent()):
+	case state != nil || stateErr != nil:
+		// the remote file changed since the state was recorded,
+		// or the .part file doesn't hold the ranges it records, start over
+		state = newResumeState(p.Stream.URL)
+		if partExists {
+			if err := os.Truncate(partPath, 0); err != nil {
+				return err
+			}
+		}
+	case p.Stream.URL.Size < 0:
+		// nothing tells how much of the partial file is valid, start over
+		state = newResumeState(p.Stream.URL)
+		if partExists {
+			if err := os.Truncate(partPath, 0); err != nil {
+				return err
+			}
+		}
+	case partSize > p.Stream.URL.Size:
+		// a partial file without state of a larger remote file, start over
+		state = newResumeState(p.Stream.URL)
+		if err := os.Truncate(partPath, 0); err != nil {
+			return err
+		}
+	default:
+		// a partial file without state was written by a single stream
+		state = newResumeState(p.Stream.URL)
+		if partSize > 0 && partSize < p.Stream.URL.Size {
+			state.add(Segment{Start: 0, End: partSize - 1})
 		}
-		temp += written
-		headers["Range"] = fmt.Sprintf("bytes=%d-", temp)
-		time.Sleep(1 * time.Second)
 	}
 
+	digest, err := newDigester(p.checksums())
+	if err != nil {
+		return err
+	}
+	if err := p.checkSpace(partPath); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
 	// close file
 	defer func() {
 		if file != nil {
 			file.Close()
 		}
 	}()
+	if err := p.allocate(file); err != nil {
+		return err
+	}
+	progress.Start(p.Stream.URL.Size, state.Written())
+
+	stop := state.autosave(file, statePath, time.Second)
+	err = p.saveStream(ctx, file, state, digest, progress)
+	if err == errRemoteChanged {
+		// download the new remote file from the beginning
+		validator := p.Stream.URL.ifRange()
+		if _, err = p.refresh(ctx); err == nil {
+			// unchanged validators mean the server doesn't honor Range after all
+			if validator == p.Stream.URL.ifRange() {
+				p.Stream.URL.AcceptRanges = false
+			}
+			err = p.restart(file, state, progress)
+		}
+		if err == nil {
+			err = p.checkSpace(partPath)
+		}
+		if err == nil {
+			err = p.allocate(file)
+		}
+		if err == nil {
+			digest, err = newDigester(p.checksums())
+		}
+		if err == nil {
+			err = p.saveStream(ctx, file, state, digest, progress)
+		}
+	}
+	stop()
+	if err != nil {
+		state.checkpoint(file, statePath)
+		return err
+	}
+	if written := state.Written(); p.Stream.URL.Size >= 0 && written < p.Stream.URL.Size {
+		state.checkpoint(file, statePath)
+		return &ShortReadError{Written: written, Size: p.Stream.URL.Size}
+	}
+	if p.Pieces != nil {
+		if err := p.verifyPieces(ctx, file, state, digest, progress); err != nil {
+			state.checkpoint(file, statePath)
+			return err
+		}
+	}
+	if err := p.finish(file, filePath, digest); err != nil {
+		if _, ok := err.(*ChecksumError); ok {
+			// the bytes on disk are wrong, download them again next time
+			state.reset(p.Stream.URL)
+			state.checkpoint(file, statePath)
+		}
+		return err
+	}
+	file = nil
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if p.Sync {
+		return p.saveSync(filePath)
+	}
 	return nil
 }
 
+// finish checks size and checksums of the complete .part file,
+// flushes it and renames it to filePath
+func (p *Porter) finish(file *os.File, filePath string, digest *digester) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if p.Stream.URL.Size < 0 {
+		// the stream ended cleanly, so its size is now known
+		p.Stream.URL.Size = info.Size()
+		p.Stream.Size = info.Size()
+	}
+	if info.Size() != p.Stream.URL.Size {
+		return &ShortReadError{Written: info.Size(), Size: p.Stream.URL.Size}
+	}
+	if digest != nil {
+		// segments are written out of order, so their file is hashed at the end
+		if digest.written != info.Size() {
+			if err := digest.hashFile(file, info.Size()); err != nil {
+				return err
+			}
+		}
+		if err := digest.verify(); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filePath)
+}
 
-func progressBar(size int64) *pb.ProgressBar {
-	bar := pb.New64(size).SetUnits(pb.U_BYTES).SetRefreshRate(time.Millisecond * 10)
-	bar.ShowSpeed = true
-	bar.ShowFinalTime = true
-	bar.SetMaxWidth(1000)
-	return bar
-}
\ No newline at end of file
+// saveStream downloads the ranges missing from state into file
+func (p *Porter) saveStream(ctx context.Context, file output, state *ResumeState, digest *digester, progress ProgressReporter) error {
+	if p.segmented() && seekable(file, digest) {
+		return p.saveSegments(ctx, file, state, progress)
+	}
+	// begin download
+	writer := &offsetWriter{file: file, offset: state.Prefix(), end: -1, state: state, digest: digest}
+	if p.Stream.URL.Size >= 0 && writer.offset >= p.Stream.URL.Size {
+		return nil
+	}
+	if digest != nil && digest.written != writer.offset {
+		// hash what is already on disk before appending to it
+		r, _ := readable(file)
+		if err := digest.hashFile(r, writer.offset); err != nil {
+			return err
+		}
+	}
+	progress.Start(p.Stream.URL.Size, writer.offset)
+	return p.attempt(ctx, progress, func(src *source) (int64, error) {
+		if writer.offset > 0 && !p.Stream.URL.resumable() && rewindable(file) {
+			// a stream of unknown size without validators is fetched anew
+			if err := p.restart(file, state, progress); err != nil {
+				return 0, err
+			}
+			writer.offset = 0
+			if digest != nil {
+				digest.Reset()
+			}
+		}
+		n, err := p.writeFile(ctx, src, writer, p.rangeHeaders(src, writer.offset, -1), progress)
+		// a clean end of a stream of unknown size completes it
+		if err == nil && p.Stream.URL.Size >= 0 && writer.offset < p.Stream.URL.Size {
+			err = &ShortReadError{Written: writer.offset, Size: p.Stream.URL.Size}
+		}
+		return n, err
+	})
+}
+
+// rangeHeaders returns the custom headers plus those requesting bytes
+// from start to end of src, a negative end means up to the end of the file
+func (p *Porter) rangeHeaders(src *source, start, end int64) map[string]string {
+	headers := map[string]string{}
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	if start == 0 && end < 0 {
+		return headers
+	}
+	// range start from 0, 0-1023 means the first 1024 bytes of the file
+	if end < 0 {
+		headers["Range"] = fmt.Sprintf("bytes=%d-", start)
+	} else {
+		headers["Range"] = fmt.Sprintf("bytes=%d-%d", start, end)
+	}
+	if v := src.url.ifRange(); v != "" {
+		headers["If-Range"] = v
+	}
+	return headers
+}
@@ -0,0 +1,1803 @@
+package porter
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/supeanut/ghttpload/httplib"
+	"github.com/supeanut/ghttpload/pkg/util"
+	"github.com/supeanut/ghttpload/request"
+)
+
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func testServer(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+}
+
+func testPorter(t *testing.T, url string) (*Porter, string) {
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPorter()
+	p.SetUrl(url + "/file.ts")
+	p.SetPath(dir)
+	p.SetFilename("file.ts")
+	p.SetProgress(NopReporter{})
+	return p, dir
+}
+
+func TestSplitSegments(t *testing.T) {
+	segments := splitSegments(10, 3)
+	if len(segments) != 3 {
+		t.Fatalf("got %d segments", len(segments))
+	}
+	var total int64
+	for i, s := range segments {
+		if i > 0 && s.Start != segments[i-1].End+1 {
+			t.Fatalf("segment %d not contiguous: %v", i, segments)
+		}
+		total += s.Size()
+	}
+	if total != 10 {
+		t.Fatalf("segments cover %d bytes", total)
+	}
+	if n := len(splitSegments(2, 8)); n != 2 {
+		t.Fatalf("got %d segments for 2 bytes", n)
+	}
+}
+
+func TestDownloadSegmented(t *testing.T) {
+	content := testContent(1 << 20)
+	ts := testServer(content)
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetConnections(4)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Stream.URL.AcceptRanges {
+		t.Fatal("expected server to accept ranges")
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("downloaded content not match")
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := testContent(1 << 16)
+	ts := testServer(content)
+	defer ts.Close()
+
+	for _, c := range []struct {
+		etag string
+		part bool
+	}{{`"v1"`, true}, {`"v0"`, true}, {`"v1"`, false}} {
+		etag := c.etag
+		p, dir := testPorter(t, ts.URL)
+		defer os.RemoveAll(dir)
+		sum := sha256.Sum256(content)
+		p.SetChecksum("sha256", hex.EncodeToString(sum[:]))
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		filePath := filepath.Join(dir, "file.ts")
+		// the first half on disk is garbage when the state is stale
+		partial := append([]byte{}, content[:1<<15]...)
+		if etag != `"v1"` {
+			partial = make([]byte, 1<<15)
+		}
+		// a state without its .part file records bytes which are gone
+		if c.part {
+			if err := ioutil.WriteFile(filePath+PartSuffix, partial, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		state := &ResumeState{Url: p.Stream.URL.Url, ETag: etag, Size: int64(len(content)),
+			Completed: []Segment{{Start: 0, End: 1<<15 - 1}}}
+		b, _ := json.Marshal(state)
+		if err := ioutil.WriteFile(filePath+StateSuffix, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.Download(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Fatalf("etag %s, part %v: downloaded content not match", etag, c.part)
+		}
+		for _, suffix := range []string{StateSuffix, PartSuffix} {
+			if _, err := os.Stat(filePath + suffix); !os.IsNotExist(err) {
+				t.Fatalf("etag %s: %s file not removed", etag, suffix)
+			}
+		}
+	}
+}
+
+func TestDownloadLeftover(t *testing.T) {
+	content := testContent(1 << 16)
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var mu sync.Mutex
+	var ranges []string
+	var lastModified time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		modtime := lastModified
+		mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.ts", modtime, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	larger := append(testContent(1<<17), 1)
+	for _, c := range []struct {
+		name     string
+		suffix   string
+		data     []byte
+		modified time.Time
+		mtime    time.Time
+		rng      string
+	}{
+		{"part file", PartSuffix, content[:1<<15], time.Time{}, time.Now(), "bytes=32768-"},
+		{"partial file at the final path", "", content[:1<<15], modified, time.Now(), "bytes=32768-"},
+		// nothing tells which version of the remote file an older file holds
+		{"partial file at the final path without Last-Modified", "", content[:1<<15], time.Time{}, time.Now(), ""},
+		{"partial file at the final path older than the remote file", "", content[:1<<15], modified, modified.Add(-time.Hour), ""},
+		{"larger part file", PartSuffix, larger, modified, time.Now(), ""},
+		{"larger file at the final path", "", larger, modified, time.Now(), ""},
+	} {
+		mu.Lock()
+		lastModified = c.modified
+		mu.Unlock()
+		p, dir := testPorter(t, ts.URL)
+		defer os.RemoveAll(dir)
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		filePath := filepath.Join(dir, "file.ts")
+		if err := ioutil.WriteFile(filePath+c.suffix, c.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filePath+c.suffix, c.mtime, c.mtime); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		ranges = nil
+		mu.Unlock()
+		// the second download finds the file complete
+		for i := 0; i < 2; i++ {
+			if err := p.Download(); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil || !bytes.Equal(b, content) {
+			t.Fatalf("%s: downloaded content not match: %v", c.name, err)
+		}
+		if len(ranges) != 1 || ranges[0] != c.rng {
+			t.Fatalf("%s: got requests for ranges %q, want %q", c.name, ranges, c.rng)
+		}
+	}
+}
+
+func TestDownloadRangeIgnored(t *testing.T) {
+	content := testContent(1 << 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(dir, "file.ts")
+	if err := ioutil.WriteFile(filePath, content[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatalf("downloaded %d bytes, content not match", len(b))
+	}
+}
+
+func TestDownloadContextCancel(t *testing.T) {
+	content := testContent(1 << 16)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write(content[:1<<15])
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetRetries(-1)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := p.DownloadContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	filePath := filepath.Join(dir, "file.ts")
+	state, err := loadResumeState(filePath + StateSuffix)
+	if err != nil || state == nil {
+		t.Fatalf("state not saved: %v", err)
+	}
+	if state.Prefix() != 1<<15 {
+		t.Fatalf("state records %d bytes, want %d", state.Prefix(), 1<<15)
+	}
+	// the part file is preallocated
+	if size, _, _ := util.FileSize(filePath + PartSuffix); size != 1<<16 {
+		t.Fatalf("part file has %d bytes", size)
+	}
+	if size, err := p.GetFileSize(); err != nil || size != 1<<15 {
+		t.Fatalf("got size %d: %v", size, err)
+	}
+	// without its state the preallocated part file isn't a complete download
+	os.Remove(filePath + StateSuffix)
+	if size, err := p.GetFileSize(); err != nil || size != 0 {
+		t.Fatalf("got size %d without state: %v", size, err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	content := testContent(1 << 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		// serve slowly so the download can be paused halfway
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), &slowReader{bytes.NewReader(content)})
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.State(); s != StateIdle {
+		t.Fatalf("state %s before download", s)
+	}
+	done := make(chan error)
+	go func() {
+		done <- p.Download()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	p.Pause()
+	if s := p.State(); s != StatePaused {
+		t.Fatalf("state %s after pause", s)
+	}
+	time.Sleep(50 * time.Millisecond)
+	size, err := p.GetFileSize()
+	if err != nil || size == 0 || size == int64(len(content)) {
+		t.Fatalf("paused at %d bytes: %v", size, err)
+	}
+	p.Resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s := p.State(); s != StateCompleted {
+		t.Fatalf("state %s after download", s)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("downloaded content not match")
+	}
+}
+
+// slowReader reads 1KB every millisecond
+type slowReader struct {
+	*bytes.Reader
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	if len(b) > 1024 {
+		b = b[:1024]
+	}
+	return r.Reader.Read(b)
+}
+
+func TestChanReporter(t *testing.T) {
+	content := testContent(1 << 16)
+	ts := testServer(content)
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	reporter := NewChanReporter(16)
+	p.SetProgress(reporter)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Download()
+		close(reporter.C)
+	}()
+	var last ProgressEvent
+	for e := range reporter.C {
+		last = e
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if last.Type != ProgressComplete || last.Current != int64(len(content)) || last.Total != int64(len(content)) {
+		t.Fatalf("last event %+v", last)
+	}
+}
+
+func TestDownloadError(t *testing.T) {
+	gets := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", "1024")
+			return
+		}
+		gets++
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetRetryPolicy(httplib.RetryPolicy{Retries: 1, BaseDelay: time.Millisecond})
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	err := p.Download()
+	e, ok := err.(*DownloadError)
+	if !ok {
+		t.Fatalf("got error %v, want *DownloadError", err)
+	}
+	if e.Attempts != 2 || gets != 2 {
+		t.Fatalf("got %d attempts and %d requests, want 2", e.Attempts, gets)
+	}
+	if se, ok := e.Err.(*request.StatusError); !ok || se.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got cause %v, want 503", e.Err)
+	}
+	if p.Err != err {
+		t.Fatalf("Porter.Err is %v", p.Err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.ts")); !os.IsNotExist(err) {
+		t.Fatal("failed download moved to final path")
+	}
+}
+
+func TestDownloadPermanentError(t *testing.T) {
+	gets := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", "1024")
+			return
+		}
+		gets++
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetRetries(-1)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	err := p.Download()
+	e, ok := err.(*DownloadError)
+	if !ok {
+		t.Fatalf("got error %v, want *DownloadError", err)
+	}
+	if e.Attempts != 1 || gets != 1 {
+		t.Fatalf("got %d attempts and %d requests for a 404, want 1", e.Attempts, gets)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	content := testContent(1 << 16)
+	sum := md5.Sum(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	for _, connections := range []int{1, 4} {
+		p, dir := testPorter(t, ts.URL)
+		defer os.RemoveAll(dir)
+		p.SetConnections(connections)
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Download(); err != nil {
+			t.Fatal(err)
+		}
+
+		p, dir = testPorter(t, ts.URL)
+		defer os.RemoveAll(dir)
+		p.SetConnections(connections)
+		p.SetChecksum("sha256", hex.EncodeToString(make([]byte, sha256.Size)))
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := p.Download().(*ChecksumError); !ok {
+			t.Fatalf("connections %d: got error %v, want *ChecksumError", connections, p.Err)
+		}
+		filePath := filepath.Join(dir, "file.ts")
+		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+			t.Fatalf("connections %d: mismatching file moved to final path", connections)
+		}
+		if _, err := os.Stat(filePath + PartSuffix); err != nil {
+			t.Fatalf("connections %d: part file: %v", connections, err)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	content := testContent(48 << 10)
+	ts := testServer(content)
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetRateLimit(32 << 10)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	// the first 32KB pass at once, the rest takes half a second
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("download took %s, limit not applied", d)
+	}
+}
+
+func TestDownloadMirrors(t *testing.T) {
+	content := testContent(1 << 20)
+	primary := testServer(content)
+	defer primary.Close()
+	mirror := testServer(content)
+	defer mirror.Close()
+	other := testServer(content[:1<<19])
+	defer other.Close()
+
+	p, dir := testPorter(t, primary.URL)
+	defer os.RemoveAll(dir)
+	p.SetConnections(4)
+	p.AddMirror(mirror.URL + "/file.ts")
+	p.AddMirror(other.URL + "/file.ts")
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+	stats := p.MirrorStats()
+	if len(stats) != 3 {
+		t.Fatalf("got %d mirror stats", len(stats))
+	}
+	if stats[0].Bytes == 0 || stats[1].Bytes == 0 || stats[0].Bytes+stats[1].Bytes != int64(len(content)) {
+		t.Fatalf("segments not spread across mirrors: %+v", stats)
+	}
+	if stats[2].Bytes != 0 || stats[2].Err == nil {
+		t.Fatalf("mirror of another size used: %+v", stats[2])
+	}
+}
+
+func TestMirrorFailover(t *testing.T) {
+	content := testContent(1 << 16)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer primary.Close()
+	mirror := testServer(content)
+	defer mirror.Close()
+
+	p, dir := testPorter(t, primary.URL)
+	defer os.RemoveAll(dir)
+	p.SetRetries(0)
+	p.AddMirror(mirror.URL + "/file.ts")
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	stats := p.MirrorStats()
+	if stats[0].Err == nil || stats[1].Bytes != int64(len(content)) {
+		t.Fatalf("failing primary not replaced by mirror: %+v", stats)
+	}
+}
+
+func TestMirrorPrimaryDown(t *testing.T) {
+	content := testContent(1 << 16)
+	var down int32 = 1
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "down", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer primary.Close()
+	mirror := testServer(content)
+	defer mirror.Close()
+
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	download := func() *Porter {
+		p := NewPorter()
+		p.SetUrl(primary.URL + "/file.ts")
+		p.AddMirror(mirror.URL + "/file.ts")
+		p.SetPath(dir)
+		p.SetFilename("file.ts")
+		p.SetProgress(NopReporter{})
+		p.SetRetries(0)
+		p.SetSync(true)
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Download(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	p := download()
+	if p.Stream.URL.Url != primary.URL+"/file.ts" {
+		t.Fatalf("primary url replaced by %s", p.Stream.URL.Url)
+	}
+	stats := p.MirrorStats()
+	if stats[0].Err == nil || stats[0].Bytes != 0 || stats[1].Bytes != int64(len(content)) {
+		t.Fatalf("failing primary not replaced by mirror: %+v", stats)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+
+	// the sync record belongs to the primary url, which is asked once it is back
+	atomic.StoreInt32(&down, 0)
+	if p = download(); !p.Stream.Unchanged {
+		t.Fatal("file downloaded again after the primary came back")
+	}
+}
+
+func TestMirrorSlow(t *testing.T) {
+	mirrorCheck = 20 * time.Millisecond
+	defer func() { mirrorCheck = 2 * time.Second }()
+	content := testContent(1 << 20)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), &slowReader{bytes.NewReader(content)})
+	}))
+	defer primary.Close()
+	mirror := testServer(content)
+	defer mirror.Close()
+
+	p, dir := testPorter(t, primary.URL)
+	defer os.RemoveAll(dir)
+	p.SetConnections(2)
+	p.AddMirror(mirror.URL + "/file.ts")
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	// the half on the primary alone takes over half a second
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Fatalf("download took %v", d)
+	}
+	stats := p.MirrorStats()
+	if stats[0].Err != errMirrorSlow || stats[1].Bytes <= stats[0].Bytes {
+		t.Fatalf("slow primary not replaced by mirror: %+v", stats)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+}
+
+func TestDownloadUnknownSize(t *testing.T) {
+	content := testContent(1 << 16)
+	gets := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// flushing before the body makes the response chunked, without Content-Length
+		w.(http.Flusher).Flush()
+		if r.Method == "HEAD" {
+			return
+		}
+		gets++
+		if r.Header.Get("Range") != "" {
+			t.Errorf("range requested without validators: %s", r.Header.Get("Range"))
+		}
+		w.Write(content[:1<<15])
+		w.(http.Flusher).Flush()
+		if gets == 1 {
+			// break the connection halfway through the first response
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(content[1<<15:])
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetRetryPolicy(httplib.RetryPolicy{Retries: 1, BaseDelay: time.Millisecond})
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Stream.URL.Size != -1 || p.Stream.Size != -1 {
+		t.Fatalf("got size %d, want -1", p.Stream.URL.Size)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+	if gets != 2 || p.Stream.URL.Size != int64(len(content)) {
+		t.Fatalf("got %d requests and size %d", gets, p.Stream.URL.Size)
+	}
+}
+
+func TestDetectName(t *testing.T) {
+	tests := []struct {
+		disposition, url, contentType string
+		name                          string
+		source                        NameSource
+	}{
+		{`attachment; filename="report.pdf"`, "/download.php", "", "report.pdf", NameFromContentDisposition},
+		{`attachment; filename="rates.txt"; filename*=UTF-8''%E2%82%AC%20rates.txt`, "/x", "", "€ rates.txt", NameFromContentDisposition},
+		{`attachment; filename=../../etc/passwd`, "/x", "", "passwd", NameFromContentDisposition},
+		{`attachment; filename=".."`, "/video.ts", "", "video.ts", NameFromURL},
+		{"", "/files/archive", "application/zip", "archive.zip", NameFromURL},
+		{"", "/", "video/mp2t; charset=binary", "download.ts", NameFromContentType},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse("http://example.com" + test.url)
+		resp := &http.Response{Header: http.Header{}, Request: &http.Request{URL: u}}
+		resp.Header.Set("Content-Disposition", test.disposition)
+		resp.Header.Set("Content-Type", test.contentType)
+		name, source := detectName(resp)
+		if name != test.name || source != test.source {
+			t.Errorf("%q %q: got %q from %s, want %q from %s", test.disposition, test.url, name, source, test.name, test.source)
+		}
+	}
+}
+
+func TestExtractName(t *testing.T) {
+	content := testContent(1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download.php" {
+			http.Redirect(w, r, "/files/video.ts", http.StatusFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	p := NewPorter()
+	p.SetUrl(ts.URL + "/download.php?id=7")
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Filename != "video.ts" || p.Stream.NameSource != NameFromURL || p.Stream.URL.Ext != "ts" {
+		t.Fatalf("got name %q from %s with ext %q", p.Filename, p.Stream.NameSource, p.Stream.URL.Ext)
+	}
+}
+
+func TestParsePlaylist(t *testing.T) {
+	base, _ := url.Parse("http://example.com/live/master.m3u8")
+	variants, playlist, err := parsePlaylist([]byte(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2400000,RESOLUTION=1280x720
+http://cdn.example.com/high/index.m3u8
+`), base)
+	if err != nil || playlist != nil || len(variants) != 2 {
+		t.Fatalf("got %v, %v, %v", variants, playlist, err)
+	}
+	if v := variants[0]; v.Url != "http://example.com/live/low/index.m3u8" || v.Codecs != "avc1.4d401e,mp4a.40.2" {
+		t.Fatalf("got variant %+v", v)
+	}
+	for _, c := range []struct {
+		s    VariantSelect
+		want int64
+	}{
+		{VariantSelect{}, 2400000},
+		{VariantSelect{Resolution: "640x360"}, 800000},
+		{VariantSelect{MaxBandwidth: 1000000}, 800000},
+		{VariantSelect{MaxBandwidth: 1}, 800000},
+	} {
+		if got := c.s.pick(variants).Bandwidth; got != c.want {
+			t.Errorf("%+v picked %d, want %d", c.s, got, c.want)
+		}
+	}
+
+	_, playlist, err = parsePlaylist([]byte(`#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:4.0,
+seg5.ts
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-BYTERANGE:100@0
+#EXTINF:4.0,
+all.ts
+#EXT-X-BYTERANGE:50
+#EXTINF:4.0,
+all.ts
+#EXT-X-ENDLIST
+`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist.Live || len(playlist.Segments) != 4 {
+		t.Fatalf("got %+v", playlist)
+	}
+	s := playlist.Segments
+	if s[0].Url != "http://example.com/live/init.mp4" || s[0].Key != nil {
+		t.Fatalf("got init section %+v", s[0])
+	}
+	if s[1].Key == nil || s[1].Key.Url != "http://example.com/live/key.bin" || s[1].Key.IV[15] != 5 {
+		t.Fatalf("got key %+v", s[1].Key)
+	}
+	if s[2].Key != nil || *s[2].Range != (Segment{Start: 0, End: 99}) || *s[3].Range != (Segment{Start: 100, End: 149}) {
+		t.Fatalf("got ranges %v and %v", s[2].Range, s[3].Range)
+	}
+	if _, _, err := parsePlaylist([]byte("<html>"), base); err == nil {
+		t.Fatal("parsed a page which isn't a playlist")
+	}
+}
+
+func TestDownloadHLS(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var want []byte
+	segments := map[string][]byte{}
+	for i := 0; i < 6; i++ {
+		content := testContent(1000 + i*100)
+		want = append(want, content...)
+		// segments are encrypted with AES-128-CBC, the IV is the media sequence number
+		pad := aes.BlockSize - len(content)%aes.BlockSize
+		data := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+		iv := make([]byte, aes.BlockSize)
+		iv[15] = byte(i)
+		block, _ := aes.NewCipher(key)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+		segments["/hd/"+strconv.Itoa(i)+".ts"] = data
+	}
+	var fetched int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000\nsd/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900000\nhd/index.m3u8\n"))
+		case "/hd/index.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Write([]byte("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"/key\"\n"))
+			for i := 0; i < 6; i++ {
+				fmt.Fprintf(w, "#EXTINF:2.0,\n%d.ts\n", i)
+			}
+			w.Write([]byte("#EXT-X-ENDLIST\n"))
+		case "/key":
+			w.Write(key)
+		default:
+			data, ok := segments[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			atomic.AddInt32(&fetched, 1)
+			w.Write(data)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := NewPorter()
+	p.SetUrl(ts.URL + "/master.m3u8")
+	p.SetPath(dir)
+	p.SetProgress(NopReporter{})
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Filename != "master.ts" || p.Stream.Playlist.Variant.Bandwidth != 900000 {
+		t.Fatalf("got %q, variant %+v", p.Filename, p.Stream.Playlist.Variant)
+	}
+
+	// a segment left from an earlier run is not fetched again
+	segmentsDir := filepath.Join(dir, "master.ts"+SegmentsSuffix)
+	os.MkdirAll(segmentsDir, 0755)
+	job := &segmentsJob{dir: segmentsDir}
+	if err := job.prepare(segmentIDs(p.Stream.Playlist.Segments)); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(segmentsDir, "000002"), want[2100:3300], 0644)
+
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "master.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+	if n := atomic.LoadInt32(&fetched); n != 5 {
+		t.Fatalf("fetched %d segments, want 5", n)
+	}
+	if _, err := os.Stat(segmentsDir); !os.IsNotExist(err) {
+		t.Fatalf("segments directory left behind: %v", err)
+	}
+}
+
+func TestDownloadHLSVariantChange(t *testing.T) {
+	segments := map[string][]byte{}
+	var sd []byte
+	for i := 0; i < 4; i++ {
+		segments["/sd/"+strconv.Itoa(i)+".ts"] = testContent(500 + i)
+		segments["/hd/"+strconv.Itoa(i)+".ts"] = testContent(2000 + i)
+		sd = append(sd, segments["/sd/"+strconv.Itoa(i)+".ts"]...)
+	}
+	var broken int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000\nsd/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900000\nhd/index.m3u8\n"))
+		case "/sd/index.m3u8", "/hd/index.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Write([]byte("#EXTM3U\n"))
+			for i := 0; i < 4; i++ {
+				fmt.Fprintf(w, "#EXTINF:2.0,\n%d.ts\n", i)
+			}
+			w.Write([]byte("#EXT-X-ENDLIST\n"))
+		default:
+			data, ok := segments[r.URL.Path]
+			if !ok || r.URL.Path == "/hd/3.ts" && atomic.LoadInt32(&broken) == 1 {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	download := func(variant VariantSelect) error {
+		p := NewPorter()
+		p.SetUrl(ts.URL + "/master.m3u8")
+		p.SetPath(dir)
+		p.SetProgress(NopReporter{})
+		p.Variant = variant
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		return p.Download()
+	}
+	// the hd variant stops at its last segment and leaves the others behind
+	if err := download(VariantSelect{}); err == nil {
+		t.Fatal("broken segment downloaded")
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "master.ts"+SegmentsSuffix, "00000*"))
+	if len(names) == 0 {
+		t.Fatal("no segments left from the interrupted run")
+	}
+
+	atomic.StoreInt32(&broken, 0)
+	if err := download(VariantSelect{MaxBandwidth: 100000}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "master.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sd) {
+		t.Fatalf("got %d bytes, want the %d bytes of the sd variant", len(got), len(sd))
+	}
+}
+
+// countReporter adds up the bytes reported
+type countReporter struct {
+	NopReporter
+	n int64
+}
+
+func (r *countReporter) Add(n int64) {
+	atomic.AddInt64(&r.n, n)
+}
+
+func TestDownloadHLSRetryProgress(t *testing.T) {
+	content := testContent(1 << 14)
+	var failed int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file.ts":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Write([]byte("#EXTM3U\n#EXTINF:2.0,\n0.ts\n#EXT-X-ENDLIST\n"))
+		case "/0.ts":
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			if atomic.CompareAndSwapInt32(&failed, 0, 1) {
+				// the first attempt breaks off halfway
+				w.Write(content[:len(content)/2])
+				return
+			}
+			w.Write(content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	reporter := &countReporter{}
+	p.SetProgress(reporter)
+	p.SetRetries(1)
+	p.Retry.BaseDelay = time.Millisecond
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&reporter.n); atomic.LoadInt32(&failed) != 1 || n != int64(len(content)) {
+		t.Fatalf("reported %d bytes, want %d", n, len(content))
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	base, _ := url.Parse("http://example.com/movie/manifest.mpd")
+	data := []byte(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT10S">
+  <Period>
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <SegmentTemplate initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number%03d$.m4s" timescale="1000" duration="4000"/>
+      <Representation id="v1" bandwidth="500000" codecs="avc1.4d401e" width="640" height="360"/>
+      <Representation id="v2" bandwidth="3000000" codecs="avc1.640028" width="1920" height="1080"/>
+      <Representation id="v3" bandwidth="2000000" codecs="hev1.1.6.L93" width="1920" height="1080"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4" codecs="mp4a.40.2">
+      <Representation id="a1" bandwidth="128000">
+        <SegmentTemplate initialization="a/init.mp4" media="a/$Time$.m4s" timescale="10">
+          <SegmentTimeline><S t="0" d="40" r="1"/><S d="20"/></SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`)
+	reps, err := parseManifest(data, base, map[string]RepresentationSelect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reps) != 2 || reps[0].ID != "v2" || reps[1].ID != "a1" || reps[1].Codecs != "mp4a.40.2" {
+		t.Fatalf("got %+v", reps)
+	}
+	video := reps[0].Segments
+	if len(video) != 4 || video[0].Url != "http://example.com/movie/v2/init.mp4" || video[3].Url != "http://example.com/movie/v2/003.m4s" {
+		t.Fatalf("got video segments %+v", video)
+	}
+	audio := reps[1].Segments
+	if len(audio) != 4 || audio[1].Url != "http://example.com/movie/a/0.m4s" || audio[3].Url != "http://example.com/movie/a/80.m4s" {
+		t.Fatalf("got audio segments %+v", audio)
+	}
+
+	for _, c := range []struct {
+		s    RepresentationSelect
+		want string
+	}{
+		{RepresentationSelect{Codecs: "hev1"}, "v3"},
+		{RepresentationSelect{MaxBandwidth: 2500000}, "v3"},
+		{RepresentationSelect{Codecs: "avc1", MaxBandwidth: 2500000}, "v1"},
+		{RepresentationSelect{MaxBandwidth: 1}, "v1"},
+	} {
+		reps, err := parseManifest(data, base, map[string]RepresentationSelect{"video": c.s})
+		if err != nil || reps[0].ID != c.want {
+			t.Errorf("%+v picked %+v, %v, want %s", c.s, reps[0].ID, err, c.want)
+		}
+	}
+
+	reps, err = parseManifest([]byte(`<MPD mediaPresentationDuration="PT1M">
+  <BaseURL>http://cdn.example.com/</BaseURL>
+  <Period>
+    <AdaptationSet mimeType="video/webm">
+      <Representation id="list" bandwidth="1">
+        <BaseURL>list.webm</BaseURL>
+        <SegmentList>
+          <Initialization range="0-99"/>
+          <SegmentURL mediaRange="100-199"/>
+          <SegmentURL media="other.webm"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <Representation id="base" bandwidth="1">
+        <BaseURL>audio.mp4</BaseURL>
+        <SegmentBase indexRange="800-900"><Initialization range="0-799"/></SegmentBase>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`), base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reps[0].Segments
+	if len(list) != 3 || list[0].Url != "http://cdn.example.com/list.webm" || *list[0].Range != (Segment{Start: 0, End: 99}) ||
+		*list[1].Range != (Segment{Start: 100, End: 199}) || list[2].Url != "http://cdn.example.com/other.webm" {
+		t.Fatalf("got list segments %+v", list)
+	}
+	if whole := reps[1].Segments; len(whole) != 1 || whole[0].Url != "http://cdn.example.com/audio.mp4" || whole[0].Range != nil {
+		t.Fatalf("got base segments %+v", whole)
+	}
+	if _, err := parseManifest([]byte(`<MPD type="dynamic"><Period/></MPD>`), base, nil); err == nil {
+		t.Fatal("parsed a live manifest")
+	}
+}
+
+func TestDownloadDASH(t *testing.T) {
+	files := map[string][]byte{}
+	var video, audio []byte
+	for _, name := range []string{"init", "1", "2", "3"} {
+		v, a := testContent(700), testContent(300)
+		v[0], a[0] = name[0], name[0]
+		files["/v/"+name+".m4s"], files["/a/"+name+".m4s"] = v, a
+		video, audio = append(video, v...), append(audio, a...)
+	}
+	var fetched int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream.mpd" {
+			w.Header().Set("Content-Type", "application/dash+xml")
+			w.Write([]byte(`<MPD type="static" mediaPresentationDuration="PT6S"><Period>
+<AdaptationSet contentType="video" mimeType="video/mp4">
+  <SegmentTemplate initialization="v/init.m4s" media="v/$Number$.m4s" duration="2"/>
+  <Representation id="v" bandwidth="1000"/>
+</AdaptationSet>
+<AdaptationSet contentType="audio" mimeType="audio/mp4">
+  <SegmentTemplate initialization="a/init.m4s" media="a/$Number$.m4s" duration="2"/>
+  <Representation id="a" bandwidth="100"/>
+</AdaptationSet>
+</Period></MPD>`))
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&fetched, 1)
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := NewPorter()
+	p.SetUrl(ts.URL + "/stream.mpd")
+	p.SetPath(dir)
+	p.SetProgress(NopReporter{})
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the audio init segment is left from an earlier run
+	segmentsDir := filepath.Join(dir, "stream"+SegmentsSuffix)
+	os.MkdirAll(segmentsDir, 0755)
+	_, ids := p.Stream.Manifest.segments()
+	job := &segmentsJob{dir: segmentsDir}
+	if err := job.prepare(ids); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(segmentsDir, "000004"), files["/a/init.m4s"], 0644)
+
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := p.OutputPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || filepath.Base(paths[0]) != "stream.video.mp4" || filepath.Base(paths[1]) != "stream.audio.m4a" {
+		t.Fatalf("got paths %v", paths)
+	}
+	for i, want := range [][]byte{video, audio} {
+		got, err := ioutil.ReadFile(paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s has %d bytes, want %d", paths[i], len(got), len(want))
+		}
+	}
+	if n := atomic.LoadInt32(&fetched); n != 7 {
+		t.Fatalf("fetched %d segments, want 7", n)
+	}
+	if size, _ := p.GetFileSize(); size != int64(len(video)+len(audio)) {
+		t.Fatalf("got size %d", size)
+	}
+}
+
+func TestDownloadDASHSelectionChange(t *testing.T) {
+	files := map[string][]byte{}
+	var low, audio []byte
+	for _, name := range []string{"init", "1", "2", "3"} {
+		files["/low/"+name+".m4s"] = testContent(400 + len(name))
+		files["/high/"+name+".m4s"] = testContent(900 + len(name))
+		files["/a/"+name+".m4s"] = testContent(200 + len(name))
+		low, audio = append(low, files["/low/"+name+".m4s"]...), append(audio, files["/a/"+name+".m4s"]...)
+	}
+	var broken int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream.mpd" {
+			w.Header().Set("Content-Type", "application/dash+xml")
+			w.Write([]byte(`<MPD type="static" mediaPresentationDuration="PT6S"><Period>
+<AdaptationSet contentType="video" mimeType="video/mp4">
+  <SegmentTemplate initialization="$RepresentationID$/init.m4s" media="$RepresentationID$/$Number$.m4s" duration="2"/>
+  <Representation id="low" bandwidth="1000"/>
+  <Representation id="high" bandwidth="5000"/>
+</AdaptationSet>
+<AdaptationSet contentType="audio" mimeType="audio/mp4">
+  <SegmentTemplate initialization="a/init.m4s" media="a/$Number$.m4s" duration="2"/>
+  <Representation id="a" bandwidth="100"/>
+</AdaptationSet>
+</Period></MPD>`))
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok || r.URL.Path == "/a/3.m4s" && atomic.LoadInt32(&broken) == 1 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	download := func(maxBandwidth int64) (*Porter, error) {
+		p := NewPorter()
+		p.SetUrl(ts.URL + "/stream.mpd")
+		p.SetPath(dir)
+		p.SetProgress(NopReporter{})
+		p.SetVideo("", maxBandwidth)
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		return p, p.Download()
+	}
+	// the high representation is saved, the audio stops at its last segment
+	if _, err := download(0); err == nil {
+		t.Fatal("broken segment downloaded")
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "stream"+SegmentsSuffix, "00000*"))
+	if len(names) == 0 {
+		t.Fatal("no segments left from the interrupted run")
+	}
+
+	atomic.StoreInt32(&broken, 0)
+	p, err := download(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Stream.Manifest.Representations[0].ID != "low" {
+		t.Fatalf("picked %+v", p.Stream.Manifest.Representations[0])
+	}
+	paths, err := p.OutputPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range [][]byte{low, audio} {
+		got, err := ioutil.ReadFile(paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s has %d bytes, want %d", paths[i], len(got), len(want))
+		}
+	}
+}
+
+// memWriterAt is an in-memory io.WriterAt
+type memWriterAt struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+func (m *memWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := int(off) + len(b); end > len(m.b) {
+		m.b = append(m.b, make([]byte, end-len(m.b))...)
+	}
+	return copy(m.b[off:], b), nil
+}
+
+func TestDownloadTo(t *testing.T) {
+	content := testContent(1 << 16)
+	var gets int32
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && atomic.AddInt32(&gets, 1) == 1 {
+			// break the connection halfway through the first response
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:1<<15])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetRetryPolicy(httplib.RetryPolicy{Retries: 1, BaseDelay: time.Millisecond})
+	sum := sha256.Sum256(content)
+	p.SetChecksum("sha256", hex.EncodeToString(sum[:]))
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := p.DownloadTo(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) || atomic.LoadInt32(&gets) != 2 {
+		t.Fatalf("got %d bytes in %d requests", buf.Len(), gets)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.ts"+PartSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("a file was written: %v", err)
+	}
+
+	// without a reporter nothing but the download goes to stdout
+	stdout, err := ioutil.TempFile(dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	saved := os.Stdout
+	os.Stdout = stdout
+	p.SetProgress(nil)
+	buf.Reset()
+	err = p.DownloadTo(context.Background(), &buf)
+	os.Stdout = saved
+	if err != nil || !bytes.Equal(buf.Bytes(), content) {
+		t.Fatalf("got %d bytes: %v", buf.Len(), err)
+	}
+	if info, err := stdout.Stat(); err != nil || info.Size() != 0 {
+		t.Fatalf("progress written to stdout: %v", err)
+	}
+	p.SetProgress(NopReporter{})
+
+	// the remote file changes after the first bytes were written
+	etag.Store(`"v2"`)
+	w := &streamWriter{w: ioutil.Discard, written: 10}
+	state := newResumeState(p.Stream.URL)
+	state.add(Segment{Start: 0, End: 9})
+	err = p.saveTarget(context.Background(), &target{out: w, state: state}, NopReporter{})
+	if e, ok := err.(*DownloadError); !ok || e.Err != ErrNotRewindable {
+		t.Fatalf("got %v, want %v", err, ErrNotRewindable)
+	}
+}
+
+func TestDownloadToWriterAt(t *testing.T) {
+	content := testContent(1 << 20)
+	ts := testServer(content)
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetConnections(4)
+	sum := md5.Sum(content)
+	p.SetChecksum("md5", hex.EncodeToString(sum[:]))
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	var w memWriterAt
+	if err := p.DownloadToWriterAt(context.Background(), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.b, content) {
+		t.Fatalf("got %d bytes", len(w.b))
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	p, dir := testPorter(t, "http://example.com")
+	defer os.RemoveAll(dir)
+	p.Stream.URL.Size = 1 << 20
+	file, err := os.Create(filepath.Join(dir, "file.ts"+PartSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := p.allocate(file); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := file.Stat(); info.Size() != 1<<20 {
+		t.Fatalf("got size %d", info.Size())
+	}
+}
+
+func TestDownloadDiskSpace(t *testing.T) {
+	content := testContent(1 << 16)
+	var gets int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	defer func() { freeSpace = util.FreeSpace }()
+	freeSpace = func(string) (int64, error) { return 1000, nil }
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	err := p.Download()
+	if e, ok := err.(*DiskSpaceError); !ok || e.Need != int64(len(content)) || e.Free != 1000 {
+		t.Fatalf("got %v", err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Fatalf("got %d requests", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "file.ts"+PartSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("part file written: %v", err)
+	}
+}
+
+func TestSegmentSplit(t *testing.T) {
+	content := testContent(1 << 18)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		var rs io.ReadSeeker = bytes.NewReader(content)
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			// the first range is slow, idle connections take over parts of it
+			rs = &slowReader{bytes.NewReader(content)}
+		}
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), rs)
+	}))
+	defer ts.Close()
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetConnections(2)
+	p.SetMinSegmentSize(16 << 10)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+	if stats := p.SegmentStats(); stats.Splits == 0 || stats.TakeOvers != 0 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestSegmentTakeOver(t *testing.T) {
+	content := testContent(1 << 16)
+	var stalled int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") && atomic.AddInt32(&stalled, 1) == 1 {
+			// send a little, then nothing until the client gives up
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", 1<<15-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[:1024])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	defer func(d time.Duration) { stallTimeout = d }(stallTimeout)
+	stallTimeout = 100 * time.Millisecond
+
+	p, dir := testPorter(t, ts.URL)
+	defer os.RemoveAll(dir)
+	p.SetConnections(2)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+	if stats := p.SegmentStats(); stats.TakeOvers != 1 || stats.Splits != 0 {
+		t.Fatalf("got %+v", stats)
+	}
+}
+
+func TestMinSpeed(t *testing.T) {
+	content := testContent(1 << 16)
+	var gets int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == "GET" && atomic.AddInt32(&gets, 1) == 1 {
+			// alive, but far below the minimum speed
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			for i := 0; ; i++ {
+				w.Write(content[i*10 : i*10+10])
+				w.(http.Flusher).Flush()
+				select {
+				case <-time.After(10 * time.Millisecond):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	for _, retries := range []int{0, 1} {
+		atomic.StoreInt32(&gets, 0)
+		p, dir := testPorter(t, ts.URL)
+		defer os.RemoveAll(dir)
+		p.SetMinSpeed(10<<10, 100*time.Millisecond)
+		p.SetRetryPolicy(httplib.RetryPolicy{Retries: retries, BaseDelay: time.Millisecond})
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		err := p.Download()
+		if retries == 0 {
+			if e, ok := err.(*DownloadError); !ok || e.Err != ErrTooSlow || e.Attempts != 1 {
+				t.Fatalf("got %v, want %v", err, ErrTooSlow)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+		if err != nil || !bytes.Equal(b, content) || atomic.LoadInt32(&gets) != 2 {
+			t.Fatalf("downloaded content not match in %d requests: %v", gets, err)
+		}
+	}
+}
+
+func TestParseMetalink(t *testing.T) {
+	v4 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="dir/example.iso">
+    <size>14471447</size>
+    <hash type="md5">B1946AC92492D2347C6235B4D2611184</hash>
+    <hash type="sha-256">f0ad929cd259957e160ea442eb80986b5f01fc05fce6b97e0b1eef6a9bcfbbe4</hash>
+    <hash type="sha-3">ignored</hash>
+    <pieces length="262144" type="sha-1">
+      <hash>aa</hash>
+      <hash>bb</hash>
+    </pieces>
+    <url location="de" priority="2">http://de.example.com/example.iso</url>
+    <url location="us" priority="1">https://us.example.com/example.iso</url>
+    <url>http://other.example.com/example.iso</url>
+    <url priority="1">ftp://ftp.example.com/example.iso</url>
+    <metaurl mediatype="torrent">http://example.com/example.iso.torrent</metaurl>
+  </file>
+</metalink>`
+	files, err := ParseMetalink(strings.NewReader(v4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := files[0]
+	if len(files) != 1 || f.Name != "example.iso" || f.Size != 14471447 {
+		t.Fatalf("got %+v", files)
+	}
+	if len(f.Checksums) != 2 || f.Checksums[0].Algo != "sha256" || f.Checksums[1].Hex != "b1946ac92492d2347c6235b4d2611184" {
+		t.Fatalf("got checksums %+v", f.Checksums)
+	}
+	if f.Pieces == nil || f.Pieces.Algo != "sha1" || f.Pieces.Length != 262144 || strings.Join(f.Pieces.Hashes, ",") != "aa,bb" {
+		t.Fatalf("got pieces %+v", f.Pieces)
+	}
+	if len(f.URLs) != 3 || f.URLs[0].Location != "us" || f.URLs[1].Priority != 2 || f.URLs[2].Priority != lowestPriority {
+		t.Fatalf("got urls %+v", f.URLs)
+	}
+
+	p := NewPorter()
+	p.SetMetalink(f, "DE")
+	if p.Stream.URL.Url != "http://de.example.com/example.iso" || len(p.Mirrors) != 2 || p.Mirrors[0] != "https://us.example.com/example.iso" {
+		t.Fatalf("got url %s and mirrors %v", p.Stream.URL.Url, p.Mirrors)
+	}
+	if p.Filename != "example.iso" || p.Stream.NameSource != NameFromMetalink || p.ExpectedSize != 14471447 || p.Checksum.Algo != "sha256" {
+		t.Fatalf("porter not configured: %+v", p)
+	}
+
+	v3 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.tar.gz">
+      <size>3</size>
+      <verification>
+        <hash type="sha1">a9993e364706816aba3e25717850c26c9cd0d89d</hash>
+        <pieces length="2" type="sha1">
+          <hash piece="1">cc</hash>
+          <hash piece="0">dd</hash>
+        </pieces>
+      </verification>
+      <resources>
+        <url type="http" location="us" preference="10">http://us.example.com/example.tar.gz</url>
+        <url type="http" location="fr" preference="90">http://fr.example.com/example.tar.gz</url>
+        <url type="bittorrent" preference="100">http://example.com/example.tar.gz.torrent</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+	files, err = ParseMetalink(strings.NewReader(v3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = files[0]
+	if f.Name != "example.tar.gz" || f.Size != 3 || len(f.Checksums) != 1 || f.Checksums[0].Algo != "sha1" {
+		t.Fatalf("got %+v", f)
+	}
+	if strings.Join(f.Pieces.Hashes, ",") != "dd,cc" {
+		t.Fatalf("got pieces %+v", f.Pieces)
+	}
+	if len(f.URLs) != 2 || f.URLs[0].Location != "fr" || f.URLs[0].Priority != 11 {
+		t.Fatalf("got urls %+v", f.URLs)
+	}
+
+	for _, doc := range []string{`<rss></rss>`, `<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`,
+		`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="a"><url>ftp://example.com/a</url></file></metalink>`} {
+		if _, err := ParseMetalink(strings.NewReader(doc)); err == nil {
+			t.Fatalf("no error for %s", doc)
+		}
+	}
+}
+
+func TestDownloadMetalink(t *testing.T) {
+	content := testContent(1 << 17)
+	corrupt := append([]byte{}, content...)
+	corrupt[70000]++
+	var mu sync.Mutex
+	var ranges []string
+	server := func(etag string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			body := content
+			if r.Method == http.MethodGet {
+				mu.Lock()
+				if len(ranges) == 0 {
+					body = corrupt
+				}
+				ranges = append(ranges, r.Header.Get("Range"))
+				mu.Unlock()
+			}
+			http.ServeContent(w, r, "file.ts", time.Unix(0, 0), bytes.NewReader(body))
+		}))
+	}
+	primary := server(`"v1"`)
+	defer primary.Close()
+	mirror := server(`"v2"`)
+	defer mirror.Close()
+
+	sum := sha256.Sum256(content)
+	f := MetalinkFile{
+		Name:      "file.iso",
+		Size:      int64(len(content)),
+		Checksums: []Checksum{{Algo: "sha256", Hex: hex.EncodeToString(sum[:])}},
+		Pieces:    &Pieces{Algo: "sha256", Length: 1 << 15},
+		URLs:      []MetalinkURL{{Url: primary.URL + "/file.iso", Priority: 1}, {Url: mirror.URL + "/file.iso", Priority: 2}},
+	}
+	for i := 0; i < len(content); i += 1 << 15 {
+		sum := sha256.Sum256(content[i : i+1<<15])
+		f.Pieces.Hashes = append(f.Pieces.Hashes, hex.EncodeToString(sum[:]))
+	}
+
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := NewPorter()
+	p.SetPath(dir)
+	p.SetProgress(NopReporter{})
+	p.SetMetalink(f)
+	if err := p.Extract(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.MirrorStats(); len(stats) != 2 || stats[1].Err != nil {
+		t.Fatalf("mirror with another ETag not used: %+v", stats)
+	}
+	if err := p.Download(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.iso"))
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("downloaded content not match: %v", err)
+	}
+	if len(ranges) != 2 || ranges[1] != "bytes=65536-98303" {
+		t.Fatalf("got requests for ranges %q, want the corrupt piece again", ranges)
+	}
+
+	// a size other than the metalink's is refused
+	p = NewPorter()
+	f.Size++
+	f.URLs = f.URLs[:1]
+	p.SetMetalink(f)
+	if err := p.Extract(); err == nil {
+		t.Fatal("no error for a wrong size")
+	}
+}
+
+func TestDownloadSync(t *testing.T) {
+	content := testContent(1 << 16)
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	var gets, notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag.Load().(string))
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		if r.Header.Get("If-None-Match") == etag.Load().(string) {
+			atomic.AddInt32(&notModified, 1)
+		}
+		http.ServeContent(w, r, "file.ts", modified, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "porter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	download := func(filename string) *Porter {
+		p := NewPorter()
+		p.SetUrl(ts.URL + "/file.ts")
+		p.SetPath(dir)
+		p.SetFilename(filename)
+		p.SetProgress(NopReporter{})
+		p.SetSync(true)
+		if err := p.Extract(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Download(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	p := download("file.ts")
+	info, err := os.Stat(filepath.Join(dir, "file.ts"))
+	if err != nil || !info.ModTime().Equal(modified) || p.Stream.Unchanged {
+		t.Fatalf("mtime not set from Last-Modified: %v", err)
+	}
+
+	// a 304 keeps the file without a GET
+	p = download("file.ts")
+	if !p.Stream.Unchanged || atomic.LoadInt32(&notModified) != 1 || atomic.LoadInt32(&gets) != 1 {
+		t.Fatalf("unchanged %v after %d 304s and %d GETs", p.Stream.Unchanged, notModified, gets)
+	}
+	if size, err := p.GetFileSize(); err != nil || size != int64(len(content)) {
+		t.Fatalf("got size %d: %v", size, err)
+	}
+	// a name from the response is compared with the validators of the HEAD
+	p = download("")
+	if !p.Stream.Unchanged || atomic.LoadInt32(&gets) != 1 {
+		t.Fatalf("unchanged %v after %d GETs", p.Stream.Unchanged, gets)
+	}
+
+	// content of the same size is downloaded again once the ETag changes
+	etag.Store(`"v2"`)
+	content = append([]byte{}, content...)
+	content[0]++
+	p = download("file.ts")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"))
+	if p.Stream.Unchanged || err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("changed content not downloaded: %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "file.ts"+SyncSuffix)); err != nil || !strings.Contains(string(b), `\"v2\"`) {
+		t.Fatalf("sync record not updated: %s %v", b, err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package porter
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes of disk for file with fallocate, file systems
+// without fallocate get a sparse file of that size instead
+func preallocate(file *os.File, size int64) error {
+	for {
+		err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EINTR:
+			continue
+		case syscall.EOPNOTSUPP, syscall.ENOSYS:
+			return file.Truncate(size)
+		}
+		return err
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package porter
+
+import (
+	"os"
+)
+
+// preallocate grows file to size bytes, the file system decides whether the disk is reserved
+func preallocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,190 @@
+package porter
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb"
+)
+
+// ProgressReporter receives the progress of a download.
+// Add may be called from several goroutines at once in segmented mode
+type ProgressReporter interface {
+	// Start is called when writing begins or starts over,
+	// current bytes are already on disk and total is -1 when the size is unknown
+	Start(total, current int64)
+	// Add is called with the number of bytes written
+	Add(n int64)
+	// Retry is called before attempt is made again after err
+	Retry(attempt int, err error)
+	// Complete is called once the download has finished
+	Complete()
+	// Error is called when the download stops with err
+	Error(err error)
+}
+
+// SegmentReporter is implemented by reporters which also count the media
+// segments of a playlist download, Segments may be called from several goroutines
+type SegmentReporter interface {
+	Segments(done, total int)
+}
+
+// progressWriter adapts a ProgressReporter to io.Writer
+type progressWriter struct {
+	progress ProgressReporter
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.progress.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// NopReporter ignores every progress event
+type NopReporter struct{}
+
+func (NopReporter) Start(total, current int64)   {}
+func (NopReporter) Add(n int64)                  {}
+func (NopReporter) Retry(attempt int, err error) {}
+func (NopReporter) Complete()                    {}
+func (NopReporter) Error(err error)              {}
+
+// BarReporter shows the progress as a bar on the terminal
+type BarReporter struct {
+	Bar *pb.ProgressBar
+
+	once sync.Once
+}
+
+// NewBarReporter returns a BarReporter with the default bar settings
+func NewBarReporter() *BarReporter {
+	return &BarReporter{Bar: progressBar(0)}
+}
+
+func (r *BarReporter) Start(total, current int64) {
+	if total < 0 {
+		// a bar without total only shows the bytes and the speed
+		total = 0
+	}
+	r.Bar.SetTotal64(total)
+	r.Bar.Set64(current)
+	r.once.Do(func() {
+		r.Bar.Start()
+	})
+}
+
+func (r *BarReporter) Add(n int64) {
+	r.Bar.Add64(n)
+}
+
+func (r *BarReporter) Retry(attempt int, err error) {}
+
+func (r *BarReporter) Segments(done, total int) {
+	r.Bar.Prefix(fmt.Sprintf("%d/%d segments ", done, total))
+}
+
+func (r *BarReporter) Complete() {
+	r.Bar.Finish()
+}
+
+func (r *BarReporter) Error(err error) {
+	r.Bar.Finish()
+}
+
+// ProgressEventType tells which ProgressReporter method produced an event
+type ProgressEventType int
+
+const (
+	ProgressStart ProgressEventType = iota
+	ProgressAdd
+	ProgressRetry
+	ProgressComplete
+	ProgressError
+	ProgressSegments
+)
+
+// ProgressEvent is sent by ChanReporter, Total and Current are the state after the event
+type ProgressEvent struct {
+	Type    ProgressEventType
+	Total   int64
+	Current int64
+	Attempt int
+	Err     error
+	// SegmentsDone and SegmentsTotal count the media segments of a playlist download
+	SegmentsDone  int
+	SegmentsTotal int
+}
+
+// ChanReporter sends progress events on C. Byte and segment events are dropped while C is full,
+// the other events block until they are received
+type ChanReporter struct {
+	C chan ProgressEvent
+
+	total    int64
+	current  int64
+	done     int32
+	segments int32
+}
+
+// NewChanReporter returns a ChanReporter whose channel buffers size events
+func NewChanReporter(size int) *ChanReporter {
+	return &ChanReporter{C: make(chan ProgressEvent, size)}
+}
+
+func (r *ChanReporter) event(t ProgressEventType) ProgressEvent {
+	return ProgressEvent{
+		Type:          t,
+		Total:         atomic.LoadInt64(&r.total),
+		Current:       atomic.LoadInt64(&r.current),
+		SegmentsDone:  int(atomic.LoadInt32(&r.done)),
+		SegmentsTotal: int(atomic.LoadInt32(&r.segments)),
+	}
+}
+
+func (r *ChanReporter) Start(total, current int64) {
+	atomic.StoreInt64(&r.total, total)
+	atomic.StoreInt64(&r.current, current)
+	r.C <- r.event(ProgressStart)
+}
+
+func (r *ChanReporter) Add(n int64) {
+	atomic.AddInt64(&r.current, n)
+	select {
+	case r.C <- r.event(ProgressAdd):
+	default:
+	}
+}
+
+func (r *ChanReporter) Retry(attempt int, err error) {
+	e := r.event(ProgressRetry)
+	e.Attempt, e.Err = attempt, err
+	r.C <- e
+}
+
+func (r *ChanReporter) Segments(done, total int) {
+	atomic.StoreInt32(&r.done, int32(done))
+	atomic.StoreInt32(&r.segments, int32(total))
+	select {
+	case r.C <- r.event(ProgressSegments):
+	default:
+	}
+}
+
+func (r *ChanReporter) Complete() {
+	r.C <- r.event(ProgressComplete)
+}
+
+func (r *ChanReporter) Error(err error) {
+	e := r.event(ProgressError)
+	e.Err = err
+	r.C <- e
+}
+
+func progressBar(size int64) *pb.ProgressBar {
+	bar := pb.New64(size).SetUnits(pb.U_BYTES).SetRefreshRate(time.Millisecond * 10)
+	bar.ShowSpeed = true
+	bar.ShowFinalTime = true
+	bar.SetMaxWidth(1000)
+	return bar
+}
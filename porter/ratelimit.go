@@ -0,0 +1,146 @@
+package porter
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limitBurst is the most bytes taken from a limiter at once, as much as io.Copy reads
+const limitBurst = 32 * 1024
+
+// RateLimiter throttles the bytes read by downloads,
+// it can be shared by several porters and changed while they run
+type RateLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSec, 0 or less means unlimited
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{limiter: rate.NewLimiter(rateLimit(bytesPerSec), limitBurst)}
+}
+
+func rateLimit(bytesPerSec int64) rate.Limit {
+	if bytesPerSec <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSec)
+}
+
+// SetRate changes the limit, 0 or less means unlimited
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.limiter.SetLimit(rateLimit(bytesPerSec))
+}
+
+// Rate returns the limit in bytes per second, 0 means unlimited
+func (l *RateLimiter) Rate() int64 {
+	limit := l.limiter.Limit()
+	if limit == rate.Inf {
+		return 0
+	}
+	return int64(limit)
+}
+
+// wait blocks until n more bytes may pass
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	if l.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	return l.limiter.WaitN(ctx, n)
+}
+
+// globalLimiter is shared by every Porter
+var globalLimiter = NewRateLimiter(0)
+
+// SetGlobalRateLimit limits the combined speed of all porters, 0 means unlimited
+func SetGlobalRateLimit(bytesPerSec int64) {
+	globalLimiter.SetRate(bytesPerSec)
+}
+
+// limit throttles r by the global limit and the limit of the porter
+func (p *Porter) limit(ctx context.Context, r io.Reader) io.Reader {
+	limiters := []*RateLimiter{globalLimiter}
+	if p.RateLimiter != nil {
+		limiters = append(limiters, p.RateLimiter)
+	}
+	return &limitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+// limitedReader waits for every limiter after each read
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	// read no more than a second worth of bytes so slow limits stay smooth
+	max := limitBurst
+	for _, l := range r.limiters {
+		if rate := l.Rate(); rate > 0 && rate < int64(max) {
+			max = int(rate)
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if err := l.wait(r.ctx, n); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+// DefaultMinSpeedWindow is how long a request may stay below Porter.MinSpeed
+// when no window is given
+const DefaultMinSpeedWindow = 30 * time.Second
+
+// SetMinSpeed drops and reissues a range request whose speed stays below bytesPerSec
+// for window, each reissue counts as a retry. It should be below any rate limit,
+// 0 turns it off
+func (p *Porter) SetMinSpeed(bytesPerSec int64, window time.Duration) {
+	p.MinSpeed = bytesPerSec
+	p.MinSpeedWindow = window
+}
+
+// watchMinSpeed calls cancel when fewer than MinSpeed bytes per second are counted
+// in read over a whole window. stop ends the watch, tooSlow reports whether it canceled
+func (p *Porter) watchMinSpeed(read *int64, cancel context.CancelFunc) (stop func(), tooSlow func() bool) {
+	window := p.MinSpeedWindow
+	if window <= 0 {
+		window = DefaultMinSpeedWindow
+	}
+	min := float64(p.MinSpeed)
+	done := make(chan struct{})
+	var slow int32
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		last := atomic.LoadInt64(read)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			n := atomic.LoadInt64(read)
+			if float64(n-last)/window.Seconds() < min {
+				atomic.StoreInt32(&slow, 1)
+				cancel()
+				return
+			}
+			last = n
+		}
+	}()
+	stop = func() {
+		close(done)
+	}
+	return stop, func() bool { return atomic.LoadInt32(&slow) == 1 }
+}
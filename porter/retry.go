@@ -0,0 +1,67 @@
+package porter
+
+import (
+	"context"
+	"time"
+
+	"github.com/supeanut/ghttpload/httplib"
+	"github.com/supeanut/ghttpload/request"
+)
+
+// attempt calls fn with a source until it succeeds or the retry policy gives up,
+// the last error is returned in a DownloadError. Moving to another mirror after
+// a failure uses up no retry
+func (p *Porter) attempt(ctx context.Context, progress ProgressReporter, fn func(src *source) (int64, error)) error {
+	var (
+		src      *source
+		attempts int
+		retries  int
+	)
+	policy := p.Retry
+	policy.Retries = p.Retries
+	for {
+		src = p.pickSource(src)
+		attempts++
+		written, err := fn(src)
+		if err == nil || ctx.Err() != nil || err == errRemoteChanged {
+			// neither is a failure of the source
+			p.release(src, written, nil)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if p.release(src, written, err) {
+			progress.Retry(attempts+1, err)
+			continue
+		}
+		retries++
+		if !policy.CanRetry(retries) || !p.retryable(err) {
+			return &DownloadError{Url: p.Stream.URL.Url, Attempts: attempts, Err: err}
+		}
+		progress.Retry(attempts+1, err)
+		if err := httplib.Sleep(ctx, policy.Delay(retries, retryAfter(err))); err != nil {
+			return err
+		}
+	}
+}
+
+// retryable reports whether err may go away on another attempt,
+// statuses like 404 are permanent unless the policy says otherwise
+func (p *Porter) retryable(err error) bool {
+	if err == ErrNotRewindable {
+		return false
+	}
+	if e, ok := err.(*request.StatusError); ok {
+		return p.Retry.RetryStatus(e.StatusCode)
+	}
+	return true
+}
+
+// retryAfter returns the wait the server asked for with err, if any
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*request.StatusError); ok {
+		return e.RetryAfter
+	}
+	return 0
+}
@@ -0,0 +1,364 @@
+package porter
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMinSegmentSize is the smallest range split off for an idle connection
+// when Porter.MinSegmentSize is not set
+const DefaultMinSegmentSize = 1 << 20
+
+// stallTimeout is how long a range may receive nothing before an idle connection takes it over
+var stallTimeout = 10 * time.Second
+
+// Segment is a byte range of the stream, both Start and End are inclusive
+type Segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Size returns the number of bytes in the segment
+func (s Segment) Size() int64 {
+	return s.End - s.Start + 1
+}
+
+// offsetWriter writes sequentially into an output starting at a fixed offset
+// up to end, or to the end of the file when end is negative.
+// Written bytes are recorded in state when it is not nil,
+// digest is fed by writeFile for streams written in order.
+// The end of a segment moves down when another worker takes over part of it
+type offsetWriter struct {
+	file   output
+	offset int64
+	end    int64
+	state  *ResumeState
+	digest *digester
+	// read counts the bytes of the current request for speed checks
+	read int64
+
+	// mu guards offset, end and last while the segment can be split
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.file.WriteAt(b, w.offset)
+	if n > 0 && w.state != nil {
+		w.state.add(Segment{Start: w.offset, End: w.offset + int64(n) - 1})
+	}
+	w.offset += int64(n)
+	w.last = time.Now()
+	return n, err
+}
+
+// bounds returns the next offset to write and the end of the segment
+func (w *offsetWriter) bounds() (offset, end int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.offset, w.end
+}
+
+// split gives away the second half of what is left of the segment,
+// unless both halves would be smaller than min
+func (w *offsetWriter) split(min int64) (Segment, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	left := w.end - w.offset + 1
+	if w.end < 0 || left < 2*min {
+		return Segment{}, false
+	}
+	s := Segment{Start: w.offset + left/2, End: w.end}
+	w.end = s.Start - 1
+	return s, true
+}
+
+// takeOver gives away everything left of the segment
+func (w *offsetWriter) takeOver() (Segment, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.end < 0 || w.offset > w.end {
+		return Segment{}, false
+	}
+	s := Segment{Start: w.offset, End: w.end}
+	w.end = w.offset - 1
+	return s, true
+}
+
+// idle returns how long nothing was written
+func (w *offsetWriter) idle() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Since(w.last)
+}
+
+// limit stops r at the end of the segment, which is read again before every read
+func (w *offsetWriter) limit(r io.Reader) io.Reader {
+	return segmentReader{r, w}
+}
+
+type segmentReader struct {
+	r io.Reader
+	w *offsetWriter
+}
+
+func (r segmentReader) Read(b []byte) (int, error) {
+	offset, end := r.w.bounds()
+	left := end - offset + 1
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > left {
+		b = b[:left]
+	}
+	return r.r.Read(b)
+}
+
+// segmented reports whether the stream should be fetched over several connections
+func (p *Porter) segmented() bool {
+	return p.Connections > 1 && p.Stream.URL.AcceptRanges && p.Stream.URL.Size > 0
+}
+
+// splitSegments splits size bytes into n ranges of nearly equal length
+func splitSegments(size int64, n int) []Segment {
+	if int64(n) > size {
+		n = int(size)
+	}
+	if n < 1 {
+		n = 1
+	}
+	segments := make([]Segment, 0, n)
+	step := size / int64(n)
+	var start int64
+	for i := 0; i < n; i++ {
+		end := start + step - 1
+		if i == n-1 {
+			end = size - 1
+		}
+		segments = append(segments, Segment{Start: start, End: end})
+		start = end + 1
+	}
+	return segments
+}
+
+// splitRemaining splits the remaining ranges into about n segments,
+// connections are handed out to the ranges with the most bytes per connection
+func splitRemaining(remaining []Segment, n int) []Segment {
+	parts := make([]int, len(remaining))
+	for i := range parts {
+		parts[i] = 1
+	}
+	for extra := n - len(remaining); extra > 0; extra-- {
+		best := -1
+		for i, s := range remaining {
+			if int64(parts[i]) >= s.Size() {
+				continue
+			}
+			if best == -1 || s.Size()/int64(parts[i]) > remaining[best].Size()/int64(parts[best]) {
+				best = i
+			}
+		}
+		if best == -1 {
+			break
+		}
+		parts[best]++
+	}
+	var segments []Segment
+	for i, s := range remaining {
+		for _, part := range splitSegments(s.Size(), parts[i]) {
+			segments = append(segments, Segment{Start: s.Start + part.Start, End: s.Start + part.End})
+		}
+	}
+	return segments
+}
+
+// SegmentStats tells how the ranges of segmented downloads were rescheduled
+type SegmentStats struct {
+	// Splits is how often a range was split for an idle connection
+	Splits int
+	// TakeOvers is how often an idle connection took over a stalled range
+	TakeOvers int
+}
+
+// SegmentStats returns the splits and take overs of the download so far
+func (p *Porter) SegmentStats() SegmentStats {
+	return SegmentStats{
+		Splits:    int(atomic.LoadInt32(&p.splits)),
+		TakeOvers: int(atomic.LoadInt32(&p.takeOvers)),
+	}
+}
+
+// SetMinSegmentSize sets the smallest range split off for an idle connection
+func (p *Porter) SetMinSegmentSize(size int64) {
+	p.MinSegmentSize = size
+}
+
+// scheduler hands out the ranges of a segmented download. An idle worker gets a
+// queued range, takes over a stalled range or splits the biggest range being written
+type scheduler struct {
+	p     *Porter
+	min   int64
+	stall time.Duration
+
+	mu     sync.Mutex
+	queue  []Segment
+	active map[*offsetWriter]context.CancelFunc
+	// changed is closed and replaced when a range is done
+	changed chan struct{}
+}
+
+// next returns the range for an idle worker, it waits while every range is
+// being written and none can be split. false means nothing is left
+func (s *scheduler) next(ctx context.Context) (Segment, bool) {
+	for {
+		s.mu.Lock()
+		segment, ok := s.take()
+		if ok || len(s.active) == 0 {
+			s.mu.Unlock()
+			return segment, ok
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		timer := time.NewTimer(s.stall / 4)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Segment{}, false
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// take must be called with mu held
+func (s *scheduler) take() (Segment, bool) {
+	if len(s.queue) > 0 {
+		segment := s.queue[0]
+		s.queue = s.queue[1:]
+		return segment, true
+	}
+	for w, cancel := range s.active {
+		if w.idle() < s.stall {
+			continue
+		}
+		if segment, ok := w.takeOver(); ok {
+			cancel()
+			atomic.AddInt32(&s.p.takeOvers, 1)
+			return segment, true
+		}
+	}
+	var biggest *offsetWriter
+	var most int64
+	for w := range s.active {
+		if offset, end := w.bounds(); end-offset+1 > most {
+			biggest, most = w, end-offset+1
+		}
+	}
+	if biggest != nil {
+		if segment, ok := biggest.split(s.min); ok {
+			atomic.AddInt32(&s.p.splits, 1)
+			return segment, true
+		}
+	}
+	return Segment{}, false
+}
+
+// start registers a range being written, cancel stops its worker when the range is taken over
+func (s *scheduler) start(w *offsetWriter, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.last = time.Now()
+	s.active[w] = cancel
+}
+
+// done unregisters a range and wakes the waiting workers
+func (s *scheduler) done(w *offsetWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, w)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (p *Porter) saveSegments(ctx context.Context, file output, state *ResumeState, progress ProgressReporter) error {
+	min := p.MinSegmentSize
+	if min <= 0 {
+		min = DefaultMinSegmentSize
+	}
+	sched := &scheduler{
+		p:       p,
+		min:     min,
+		stall:   stallTimeout,
+		queue:   splitRemaining(state.Remaining(), p.Connections),
+		active:  map[*offsetWriter]context.CancelFunc{},
+		changed: make(chan struct{}),
+	}
+
+	workers := p.Connections
+	if workers < 1 {
+		// corrupt pieces are fetched by range even for a single stream
+		workers = 1
+	}
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				segment, ok := sched.next(ctx)
+				if !ok || ctx.Err() != nil {
+					return
+				}
+				if err := p.saveSegment(ctx, file, segment, state, progress, sched); err != nil && errs[i] == nil {
+					errs[i] = err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var firstErr error
+	for _, err := range errs {
+		if err == errRemoteChanged {
+			return err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *Porter) saveSegment(ctx context.Context, file output, segment Segment, state *ResumeState, progress ProgressReporter, sched *scheduler) error {
+	writer := &offsetWriter{file: file, offset: segment.Start, end: segment.End, state: state}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sched.start(writer, cancel)
+	defer sched.done(writer)
+	err := p.attempt(ctx, progress, func(src *source) (int64, error) {
+		offset, end := writer.bounds()
+		if offset > end {
+			// the rest of the range was taken over between attempts
+			return 0, nil
+		}
+		n, err := p.writeFile(ctx, src, writer, p.rangeHeaders(src, offset, end), progress)
+		if offset, end := writer.bounds(); err == nil && offset <= end {
+			err = &ShortReadError{Written: offset - segment.Start, Size: end - segment.Start + 1}
+		}
+		return n, err
+	})
+	if offset, end := writer.bounds(); err != nil && offset > end {
+		// the stalled range was taken over by another worker
+		return nil
+	}
+	return err
+}
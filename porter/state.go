@@ -0,0 +1,205 @@
+package porter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StateSuffix is appended to the output path to name the resume state file
+const StateSuffix = ".ghttpload"
+
+// ResumeState is stored next to the output file while a download is in progress,
+// it records what has been written so an interrupted download can be resumed safely
+type ResumeState struct {
+	Url          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`
+	Completed    []Segment `json:"completed"`
+
+	mu sync.Mutex
+}
+
+func newResumeState(u URL) *ResumeState {
+	return &ResumeState{
+		Url:          u.Url,
+		ETag:         u.ETag,
+		LastModified: u.LastModified,
+		Size:         u.Size,
+	}
+}
+
+// loadResumeState reads the state file, a missing file returns nil state and nil error
+func loadResumeState(path string) (*ResumeState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	st := &ResumeState{}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Match reports whether the state was recorded for the same remote file as u
+func (st *ResumeState) Match(u URL) bool {
+	if !u.resumable() || st.Url != u.Url || st.Size != u.Size {
+		return false
+	}
+	return st.ETag == u.ETag && st.LastModified == u.LastModified
+}
+
+// add marks the bytes of s as written
+func (st *ResumeState) add(s Segment) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Completed = mergeSegments(append(st.Completed, s))
+}
+
+// remove marks the bytes of s as missing again
+func (st *ResumeState) remove(s Segment) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var completed []Segment
+	for _, c := range st.Completed {
+		if c.End < s.Start || c.Start > s.End {
+			completed = append(completed, c)
+			continue
+		}
+		if c.Start < s.Start {
+			completed = append(completed, Segment{Start: c.Start, End: s.Start - 1})
+		}
+		if c.End > s.End {
+			completed = append(completed, Segment{Start: s.End + 1, End: c.End})
+		}
+	}
+	st.Completed = completed
+}
+
+// reset forgets every completed range
+func (st *ResumeState) reset(u URL) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Url = u.Url
+	st.ETag = u.ETag
+	st.LastModified = u.LastModified
+	st.Size = u.Size
+	st.Completed = nil
+}
+
+// Written returns the number of bytes completed
+func (st *ResumeState) Written() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var n int64
+	for _, s := range st.Completed {
+		n += s.Size()
+	}
+	return n
+}
+
+// extent returns the size a file needs to hold every completed range
+func (st *ResumeState) extent() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.Completed) == 0 {
+		return 0
+	}
+	return st.Completed[len(st.Completed)-1].End + 1
+}
+
+// Prefix returns the length of the completed range starting at 0
+func (st *ResumeState) Prefix() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.Completed) == 0 || st.Completed[0].Start != 0 {
+		return 0
+	}
+	return st.Completed[0].End + 1
+}
+
+// Remaining returns the ranges which still have to be downloaded
+func (st *ResumeState) Remaining() []Segment {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var remaining []Segment
+	var start int64
+	for _, s := range st.Completed {
+		if s.Start > start {
+			remaining = append(remaining, Segment{Start: start, End: s.Start - 1})
+		}
+		start = s.End + 1
+	}
+	if start < st.Size {
+		remaining = append(remaining, Segment{Start: start, End: st.Size - 1})
+	}
+	return remaining
+}
+
+// checkpoint flushes file and writes the state to path. The state is marshaled
+// before the flush so it never claims bytes which are not on disk yet
+func (st *ResumeState) checkpoint(file *os.File, path string) error {
+	st.mu.Lock()
+	b, err := json.Marshal(st)
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// autosave checkpoints the state every interval until the returned func is called
+func (st *ResumeState) autosave(file *os.File, path string, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				st.checkpoint(file, path)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// mergeSegments sorts segments and joins the overlapping or adjacent ones
+func mergeSegments(segments []Segment) []Segment {
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Start < segments[j].Start
+	})
+	merged := segments[:0]
+	for _, s := range segments {
+		if n := len(merged); n > 0 && s.Start <= merged[n-1].End+1 {
+			if s.End > merged[n-1].End {
+				merged[n-1].End = s.End
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
@@ -0,0 +1,112 @@
+package porter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/supeanut/ghttpload/pkg/util"
+)
+
+// SyncSuffix is appended to the output path to name the record of a synced file
+const SyncSuffix = ".ghttpload-sync"
+
+// syncRecord holds the validators of a completed file, a later sync sends
+// them in a conditional request
+type syncRecord struct {
+	Url          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size"`
+}
+
+// SetSync keeps the validators of completed files next to them, later downloads
+// ask the server with conditional requests and keep unchanged files
+func (p *Porter) SetSync(sync bool) {
+	p.Sync = sync
+}
+
+// loadSync returns the record of the output file, nil when there is none
+// or it doesn't describe the file on disk
+func (p *Porter) loadSync() *syncRecord {
+	if p.Filename == "" {
+		return nil
+	}
+	filePath, err := p.OutputPath()
+	if err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filePath + SyncSuffix)
+	if err != nil {
+		return nil
+	}
+	var r syncRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil
+	}
+	size, exists, err := util.FileSize(filePath)
+	if err != nil || !exists || size != r.Size || r.Url != p.Stream.URL.Url {
+		return nil
+	}
+	if r.ETag == "" && r.LastModified == "" {
+		return nil
+	}
+	return &r
+}
+
+// conditions returns headers with If-None-Match and If-Modified-Since of the record
+func (r *syncRecord) conditions(headers map[string]string) map[string]string {
+	h := map[string]string{}
+	for k, v := range headers {
+		h[k] = v
+	}
+	if r.ETag != "" {
+		h["If-None-Match"] = r.ETag
+	}
+	if r.LastModified != "" {
+		h["If-Modified-Since"] = r.LastModified
+	}
+	return h
+}
+
+// matches reports whether u has the size and validators of the record,
+// for servers which answer conditional requests with the whole file
+func (r *syncRecord) matches(u URL) bool {
+	if u.Size != r.Size {
+		return false
+	}
+	if r.ETag != "" && u.ETag != "" {
+		return strings.TrimPrefix(r.ETag, "W/") == strings.TrimPrefix(u.ETag, "W/")
+	}
+	return r.LastModified != "" && r.LastModified == u.LastModified
+}
+
+// unchanged keeps the file on disk, its size and validators come from the record
+func (r *syncRecord) unchanged(p *Porter) {
+	p.Stream.URL.Size = r.Size
+	p.Stream.Size = r.Size
+	p.Stream.URL.ETag = r.ETag
+	p.Stream.URL.LastModified = r.LastModified
+	p.Stream.Unchanged = true
+}
+
+// saveSync sets the mtime of the completed file from Last-Modified and records its validators
+func (p *Porter) saveSync(filePath string) error {
+	if t, err := http.ParseTime(p.Stream.URL.LastModified); err == nil {
+		if err := os.Chtimes(filePath, t, t); err != nil {
+			return err
+		}
+	}
+	u := p.Stream.URL
+	if u.ETag == "" && u.LastModified == "" {
+		// nothing to ask the server with next time
+		return nil
+	}
+	b, err := json.Marshal(syncRecord{Url: u.Url, ETag: u.ETag, LastModified: u.LastModified, Size: u.Size})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath+SyncSuffix, b, 0644)
+}
@@ -0,0 +1,162 @@
+package porter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotRewindable is returned when a download into an io.Writer has to start
+// over, because the remote file changed, after bytes were already written
+var ErrNotRewindable = errors.New("the writer can't be rewound")
+
+// output is what a stream is written to, the .part file or a writer of the caller
+type output interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// streamWriter adapts an io.Writer to output, bytes must arrive in order
+// and it can only be truncated to the bytes already written
+type streamWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (s *streamWriter) WriteAt(b []byte, off int64) (int, error) {
+	if off != s.written {
+		return 0, fmt.Errorf("write at %d, the writer is at %d: %v", off, s.written, ErrNotRewindable)
+	}
+	n, err := s.w.Write(b)
+	s.written += int64(n)
+	return n, err
+}
+
+func (s *streamWriter) Truncate(size int64) error {
+	if size != s.written {
+		return ErrNotRewindable
+	}
+	return nil
+}
+
+// writerAt adapts an io.WriterAt to output, it is truncated when it has
+// a Truncate method and overwritten in place otherwise
+type writerAt struct {
+	io.WriterAt
+}
+
+func (w writerAt) Truncate(size int64) error {
+	if t, ok := w.WriterAt.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(size)
+	}
+	return nil
+}
+
+// rewindable reports whether out accepts writes before the bytes already written
+func rewindable(out output) bool {
+	_, ok := out.(*streamWriter)
+	return !ok
+}
+
+// readable returns out as an io.ReaderAt, if its bytes can be read back
+func readable(out output) (io.ReaderAt, bool) {
+	if w, ok := out.(writerAt); ok {
+		r, ok := w.WriterAt.(io.ReaderAt)
+		return r, ok
+	}
+	r, ok := out.(io.ReaderAt)
+	return r, ok
+}
+
+// seekable reports whether segments can be written to out out of order,
+// digest then has to read the bytes back at the end
+func seekable(out output, digest *digester) bool {
+	if !rewindable(out) {
+		return false
+	}
+	_, ok := readable(out)
+	return digest == nil || ok
+}
+
+// target is a writer of the caller and the progress written to it, kept across pauses
+type target struct {
+	out    output
+	state  *ResumeState
+	digest *digester
+}
+
+// DownloadTo writes the stream to w in order, failed requests are resumed by range
+// after the bytes already written. The stream must not change while it is written,
+// ErrNotRewindable is returned when it has to start over. No progress is shown
+// unless a reporter is set with SetProgress
+func (p *Porter) DownloadTo(ctx context.Context, w io.Writer) error {
+	return p.downloadTarget(ctx, &streamWriter{w: w})
+}
+
+// DownloadToWriterAt writes the stream to w, over several connections when
+// Connections is more than 1. Checksums are verified only in order unless w is
+// also an io.ReaderAt. Like DownloadTo it shows no progress by default
+func (p *Porter) DownloadToWriterAt(ctx context.Context, w io.WriterAt) error {
+	return p.downloadTarget(ctx, writerAt{w})
+}
+
+func (p *Porter) downloadTarget(ctx context.Context, out output) error {
+	if p.Stream.Playlist != nil || p.Stream.Manifest != nil {
+		return fmt.Errorf("%s: playlists are only saved to files", p.Stream.URL.Url)
+	}
+	digest, err := newDigester(p.checksums())
+	if err != nil {
+		return err
+	}
+	t := &target{out: out, state: newResumeState(p.Stream.URL), digest: digest}
+	progress := p.Progress
+	if progress == nil {
+		// the default bar prints to stdout, which may be the writer
+		progress = NopReporter{}
+	}
+	return p.download(ctx, progress, func(ctx context.Context, progress ProgressReporter) error {
+		return p.saveTarget(ctx, t, progress)
+	})
+}
+
+// saveTarget writes the ranges missing from the state of t, like save does for files
+func (p *Porter) saveTarget(ctx context.Context, t *target, progress ProgressReporter) error {
+	progress.Start(p.Stream.URL.Size, t.state.Written())
+	err := p.saveStream(ctx, t.out, t.state, t.digest, progress)
+	if err == errRemoteChanged {
+		// start over with the new remote file, if the writer allows it
+		if _, err = p.refresh(ctx); err == nil {
+			err = p.restart(t.out, t.state, progress)
+		}
+		if err == nil {
+			t.digest, err = newDigester(p.checksums())
+		}
+		if err == nil {
+			err = p.saveStream(ctx, t.out, t.state, t.digest, progress)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	written := t.state.Written()
+	if p.Stream.URL.Size < 0 {
+		// the stream ended cleanly, so its size is now known
+		p.Stream.URL.Size = written
+		p.Stream.Size = written
+	}
+	if written < p.Stream.URL.Size {
+		return &ShortReadError{Written: written, Size: p.Stream.URL.Size}
+	}
+	if t.digest == nil {
+		return nil
+	}
+	if t.digest.written != written {
+		// segments were written out of order, read them back
+		r, _ := readable(t.out)
+		if err := t.digest.hashFile(r, written); err != nil {
+			return err
+		}
+	}
+	return t.digest.verify()
+}
@@ -5,19 +5,49 @@ import (
 	"github.com/supeanut/ghttpload/httplib"
 	"strings"
 	"strconv"
+	"fmt"
+	"context"
+	"time"
 )
 
-func getHeader(url string) (http.Header, error) {
-	resp, err := httplib.Head(url).Response()
+// GetHeader returns the response header of a HEAD request to url,
+// error statuses are returned as *StatusError
+func GetHeader(url string) (http.Header, error) {
+	return GetHeaderContext(context.Background(), url, nil)
+}
+
+// GetHeaderContext is like GetHeader but sends headers and aborts when ctx is done
+func GetHeaderContext(ctx context.Context, url string, headers map[string]string) (http.Header, error) {
+	resp, err := HeadContext(ctx, url, headers)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	return resp.Header, nil
 }
 
+// HeadContext sends a HEAD request to url with headers and returns the response
+// with its body closed, resp.Request.URL is the final URL after redirects.
+// Error statuses are returned as *StatusError
+func HeadContext(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	req := httplib.Head(url).WithContext(ctx)
+	for k, v := range headers {
+		req.Header(k, v)
+	}
+	resp, err := req.Response()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	// the headers of an error page don't describe the file
+	if resp.StatusCode >= http.StatusBadRequest {
+		retryAfter, _ := httplib.ParseRetryAfter(resp.Header)
+		return nil, &StatusError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: retryAfter}
+	}
+	return resp, nil
+}
+
 func ContentType(url string) (string, error) {
-	h, err := getHeader(url)
+	h, err := GetHeader(url)
 	if err != nil {
 		return "", err
 	}
@@ -26,26 +56,118 @@ func ContentType(url string) (string, error) {
 	return strings.Split(s, ";")[0], nil
 }
 
+// AcceptRanges reports whether the header advertises byte range support
+func AcceptRanges(h http.Header) bool {
+	return strings.EqualFold(h.Get("Accept-Ranges"), "bytes")
+}
+
+// ContentLength parses the Content-Length of the header,
+// -1 is returned when the header is missing and the size is unknown
+func ContentLength(h http.Header) (int64, error) {
+	v := h.Get("Content-Length")
+	if v == "" {
+		return -1, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
 func GetContentSize(url string) (int64, error) {
-	h, err := getHeader(url)
+	h, err := GetHeader(url)
 	if err != nil {
 		return 0, err
 	}
-	s := h.Get("Content-Length")
-	size, err := strconv.ParseInt(s, 10, 64)
+	size, err := ContentLength(h)
 	if err != nil {
 		return 0, err
 	}
 	return size, nil
 }
 
+// StatusError is returned when the server answers with an unexpected status
+type StatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+	// RetryAfter is the wait asked for by a Retry-After header, 0 when there is none
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %s", e.Url, e.Status)
+}
+
+// ContentRangeError is returned when a partial response doesn't start at the requested offset
+type ContentRangeError struct {
+	Url          string
+	Offset       int64
+	ContentRange string
+}
+
+func (e *ContentRangeError) Error() string {
+	return fmt.Sprintf("%s: requested offset %d but got Content-Range %q", e.Url, e.Offset, e.ContentRange)
+}
+
+// ParseContentRange parses a header like "bytes 0-1023/4096",
+// total is -1 when the server sends "*" instead of the size
+func ParseContentRange(s string) (start, end, total int64, err error) {
+	total = -1
+	var size string
+	if _, err = fmt.Sscanf(s, "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+		}
+	}
+	return start, end, total, nil
+}
+
+// rangeOffset returns the first byte requested by a Range header like "bytes=1024-"
+func rangeOffset(s string) (int64, bool) {
+	var offset int64
+	if _, err := fmt.Sscanf(s, "bytes=%d-", &offset); err != nil {
+		return 0, false
+	}
+	return offset, true
+}
+
+// GetFile requests url with headers. A 200 or a 206 starting at the requested
+// offset is returned as is, other statuses come back as *StatusError and a
+// mismatching Content-Range as *ContentRangeError.
+// A 416 means the requested range is beyond the end of the remote file.
 func GetFile(url string, headers map[string]string) (*http.Response, error) {
-	req := httplib.Get(url)
-	req.SetRetrys(3)
+	return GetFileContext(context.Background(), url, headers)
+}
+
+// GetFileContext is like GetFile but aborts when ctx is done
+func GetFileContext(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	req := httplib.Get(url).WithContext(ctx)
 	if headers != nil {
 		for k,v := range headers {
 			req.Header(k,v)
 		}
 	}
-	return req.Response()
+	resp, err := req.Response()
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusPartialContent:
+		offset, ok := rangeOffset(headers["Range"])
+		if !ok {
+			break
+		}
+		start, _, _, err := ParseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			resp.Body.Close()
+			return nil, &ContentRangeError{Url: url, Offset: offset, ContentRange: resp.Header.Get("Content-Range")}
+		}
+		return resp, nil
+	}
+	resp.Body.Close()
+	retryAfter, _ := httplib.ParseRetryAfter(resp.Header)
+	return nil, &StatusError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status, RetryAfter: retryAfter}
 }